@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	arrayExpand  = "expand"
+	arrayAgg     = "agg"
+	arrayExplode = "explode"
+)
+
+// arrayStrategy says how the array at a document path is mapped.
+// expand maps each element as path.index, agg maps path.sum, path.min, path.max,
+// path.avg, path.count and path.len over the numeric elements, and explode
+// maps one point per element with the element subfields as path.subfield
+type arrayStrategy struct {
+	strategy  string
+	timefield string
+}
+
+func parseArrayStrategy(spec string) (string, *arrayStrategy, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) < 2 {
+		return "", nil, fmt.Errorf("array %s requires a strategy", spec)
+	}
+	as := &arrayStrategy{strategy: parts[1]}
+	switch as.strategy {
+	case arrayExpand, arrayAgg:
+		if len(parts) == 3 {
+			return "", nil, fmt.Errorf("array %s: only explode takes a time field", spec)
+		}
+	case arrayExplode:
+		if len(parts) == 3 {
+			as.timefield = parts[2]
+		}
+	default:
+		return "", nil, fmt.Errorf("array %s: unsupported strategy %s", spec, as.strategy)
+	}
+	return parts[0], as, nil
+}
+
+func asArray(v interface{}) ([]interface{}, bool) {
+	switch a := v.(type) {
+	case primitive.A:
+		return []interface{}(a), true
+	case []interface{}:
+		return a, true
+	default:
+		return nil, false
+	}
+}
+
+// fieldFor returns the field name and type for the document path k. Paths below
+// an expanded or aggregated array are named after the field mapped to the array
+func (im *InfluxMeasure) fieldFor(k string) (name, typ string, ok bool) {
+	if name, ok = im.fields[k]; ok {
+		return name, im.fieldTypes[k], true
+	}
+	for p := k; strings.Contains(p, "."); {
+		p = p[:strings.LastIndex(p, ".")]
+		as := im.arrays[p]
+		if as == nil || as.strategy == arrayExplode {
+			continue
+		}
+		if name, ok = im.fields[p]; ok {
+			if as.strategy == arrayExpand {
+				typ = im.fieldTypes[p]
+			}
+			return name + k[len(p):], typ, true
+		}
+	}
+	return "", "", false
+}
+
+// loadValue maps the value at path k, dispatching arrays to their strategy
+func (m *InfluxDataMap) loadValue(k string, v interface{}) error {
+	a, ok := asArray(v)
+	if !ok {
+		return m.loadKV(k, v)
+	}
+	as := m.measure.arrays[k]
+	if as == nil {
+		return nil
+	}
+	switch as.strategy {
+	case arrayExpand:
+		for i, e := range a {
+			ek := k + "." + strconv.Itoa(i)
+			if em, ok := e.(map[string]interface{}); ok {
+				for fk, fv := range m.flatmap(ek+".", em) {
+					if err := m.loadValue(fk, fv); err != nil {
+						return err
+					}
+				}
+			} else if err := m.loadValue(ek, e); err != nil {
+				return err
+			}
+		}
+	case arrayAgg:
+		for stat, sv := range aggregate(a) {
+			if err := m.loadKV(k+"."+stat, sv); err != nil {
+				return err
+			}
+		}
+	case arrayExplode:
+		m.elements = a
+		m.elementsPath = k
+	}
+	return nil
+}
+
+// aggregate summarizes the numeric elements of an array
+func aggregate(a []interface{}) map[string]interface{} {
+	var sum, min, max float64
+	var count int64
+	for _, e := range a {
+		if _, isBool := e.(bool); isBool {
+			continue
+		}
+		f, err := toFloat(e)
+		if err != nil {
+			continue
+		}
+		if count == 0 || f < min {
+			min = f
+		}
+		if count == 0 || f > max {
+			max = f
+		}
+		sum += f
+		count++
+	}
+	stats := map[string]interface{}{
+		"count": count,
+		"len":   int64(len(a)),
+	}
+	if count > 0 && !math.IsInf(sum, 0) {
+		stats["sum"] = sum
+		stats["min"] = min
+		stats["max"] = max
+		stats["avg"] = sum / float64(count)
+	}
+	return stats
+}
+
+// explode returns a mapper per element of the exploded array, or just m when
+// there is no exploded array. Elements that do not map a field are skipped
+func (m *InfluxDataMap) explode() ([]*InfluxDataMap, error) {
+	if m.elementsPath == "" {
+		return []*InfluxDataMap{m}, nil
+	}
+	as := m.measure.arrays[m.elementsPath]
+	var out []*InfluxDataMap
+	for _, e := range m.elements {
+		em := *m
+		em.elements, em.elementsPath = nil, ""
+		em.tags = make(map[string]string, len(m.tags))
+		for k, v := range m.tags {
+			em.tags[k] = v
+		}
+		em.fields = make(map[string]interface{}, len(m.fields))
+		for k, v := range m.fields {
+			em.fields[k] = v
+		}
+		if doc, ok := e.(map[string]interface{}); ok {
+			if tf, ok := lookupPath(doc, as.timefield); ok && as.timefield != "" {
+				t, err := parseTime(tf, m.measure.timefieldFormat)
+				if err != nil {
+					return nil, fmt.Errorf("time field %s.%s: %s", m.elementsPath, as.timefield, err)
+				}
+				em.t = t
+			}
+			for fk, fv := range m.flatmap(m.elementsPath+".", doc) {
+				if err := em.loadValue(fk, fv); err != nil {
+					return nil, err
+				}
+			}
+		} else if err := em.loadKV(m.elementsPath, e); err != nil {
+			return nil, err
+		}
+		if len(em.fields) > len(m.fields) {
+			out = append(out, &em)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testDoc(data map[string]interface{}) *gtm.Op {
+	op := testInsert("a", 0, 100)
+	op.Data = data
+	op.Data["_id"] = "a"
+	return op
+}
+
+func TestArrayStrategies(t *testing.T) {
+	t1 := time.Date(2019, 5, 10, 0, 0, 1, 0, time.UTC)
+	t2 := time.Date(2019, 5, 10, 0, 0, 2, 0, time.UTC)
+	tests := []struct {
+		name   string
+		tags   []string
+		fields []string
+		arrays []string
+		data   map[string]interface{}
+		want   []string
+	}{
+		{
+			name:   "expand",
+			fields: []string{"readings:r:float"},
+			arrays: []string{"readings:expand"},
+			data:   map[string]interface{}{"readings": primitive.A{1, 2.5}},
+			want:   []string{"col,id=a r.0=1,r.1=2.5 100000000000"},
+		},
+		{
+			name:   "expand documents",
+			fields: []string{"readings"},
+			arrays: []string{"readings:expand"},
+			data:   map[string]interface{}{"readings": []interface{}{map[string]interface{}{"v": 1}}},
+			want:   []string{"col,id=a readings.0.v=1i 100000000000"},
+		},
+		{
+			name:   "agg",
+			fields: []string{"scores"},
+			arrays: []string{"scores:agg"},
+			data:   map[string]interface{}{"scores": primitive.A{1, 3.0, "x", true}},
+			want:   []string{"col,id=a scores.avg=2,scores.count=2i,scores.len=4i,scores.max=3,scores.min=1,scores.sum=4 100000000000"},
+		},
+		{
+			name:   "agg without numbers",
+			fields: []string{"scores"},
+			arrays: []string{"scores:agg"},
+			data:   map[string]interface{}{"scores": primitive.A{"x"}},
+			want:   []string{"col,id=a scores.count=0i,scores.len=1i 100000000000"},
+		},
+		{
+			name:   "explode",
+			tags:   []string{"samples.sensor"},
+			fields: []string{"samples.value"},
+			arrays: []string{"samples:explode:ts"},
+			data: map[string]interface{}{"samples": primitive.A{
+				map[string]interface{}{"sensor": "s1", "value": 1, "ts": t1},
+				map[string]interface{}{"sensor": "s2", "value": 2, "ts": t2},
+			}},
+			want: []string{
+				"col,id=a,samples.sensor=s1 samples.value=1i 1557446401000000000",
+				"col,id=a,samples.sensor=s2 samples.value=2i 1557446402000000000",
+			},
+		},
+		{
+			name:   "explode skips elements without fields",
+			fields: []string{"samples.value"},
+			arrays: []string{"samples:explode"},
+			data: map[string]interface{}{"samples": primitive.A{
+				map[string]interface{}{"sensor": "s1"},
+				map[string]interface{}{"value": 2},
+			}},
+			want: []string{"col,id=a samples.value=2i 100000000000"},
+		},
+		{
+			name:   "array without strategy",
+			fields: []string{"v", "list"},
+			data:   map[string]interface{}{"v": 1, "list": primitive.A{1, 2}},
+			want:   []string{"col,id=a v=1i 100000000000"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := testMeasurement()
+			ms.Tags = append(ms.Tags, tt.tags...)
+			ms.Fields = tt.fields
+			ms.Arrays = tt.arrays
+			sink := &memorySink{}
+			ctx := newTestCtx(t, sink, 1, ms)
+			if err := ctx.addPoint(testDoc(tt.data)); err != nil {
+				t.Fatal(err)
+			}
+			if got := sink.lines(); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestArrayStrategyErrors(t *testing.T) {
+	for _, arrays := range [][]string{
+		{"samples"},
+		{"samples:sum"},
+		{"samples:agg:ts"},
+		{"samples:explode", "readings:explode"},
+	} {
+		ms := testMeasurement()
+		ms.Arrays = arrays
+		config := newConfig()
+		config.Measurement = []*measureSettings{ms}
+		if errs := config.checkMeasurements(&memorySink{}); len(errs) == 0 {
+			t.Fatalf("expected arrays %v to be rejected", arrays)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"math"
+	"sync"
+)
+
+// checkpoint coordinates the resume timestamp across all workers. Workers pull
+// ops in any order so each one reports the oldest timestamp it still has
+// buffered. Ops handed to the workers but not yet buffered by one are in flight
+// and hold back the checkpoint too. Only the low-water mark below which every
+// point has been flushed is persisted, which means a restart replays rather
+// than skips points. Change stream resume tokens are persisted per namespace
+// once the low-water mark has reached them. Without a store nothing is persisted
+// and the checkpoint only measures the replication lag
+type checkpoint struct {
+	lock     sync.Mutex
+	store    CheckpointStore
+	pending  map[int]primitive.Timestamp
+	inflight map[primitive.Timestamp]int
+	flushed  primitive.Timestamp
+	saved    primitive.Timestamp
+	tokens   map[string][]*resumeToken
+}
+
+func newCheckpoint(store CheckpointStore) *checkpoint {
+	return &checkpoint{
+		store:    store,
+		pending:  make(map[int]primitive.Timestamp),
+		inflight: make(map[primitive.Timestamp]int),
+		tokens:   make(map[string][]*resumeToken),
+	}
+}
+
+// positioned reports whether op is a position in the oplog. Direct reads are not
+func positioned(op *gtm.Op) bool {
+	return op.IsSourceOplog() && op.Timestamp.T != 0
+}
+
+func tsBefore(a, b primitive.Timestamp) bool {
+	return a.T < b.T || (a.T == b.T && a.I < b.I)
+}
+
+// tsPrev returns the timestamp immediately preceding ts
+func tsPrev(ts primitive.Timestamp) primitive.Timestamp {
+	if ts.I > 0 {
+		return primitive.Timestamp{T: ts.T, I: ts.I - 1}
+	}
+	return primitive.Timestamp{T: ts.T - 1, I: math.MaxUint32}
+}
+
+// enter records that op was handed to the workers
+func (cp *checkpoint) enter(op *gtm.Op) {
+	if !positioned(op) {
+		return
+	}
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	cp.inflight[op.Timestamp]++
+}
+
+// leave removes op from the ops in flight. Must be called with the lock held
+func (cp *checkpoint) leave(op *gtm.Op) {
+	if n := cp.inflight[op.Timestamp]; n > 1 {
+		cp.inflight[op.Timestamp] = n - 1
+	} else {
+		delete(cp.inflight, op.Timestamp)
+	}
+}
+
+// track records that worker has buffered the points of the op, which is no longer in flight
+func (cp *checkpoint) track(worker int, op *gtm.Op) {
+	if !positioned(op) {
+		return
+	}
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	if ts, ok := cp.pending[worker]; !ok || tsBefore(op.Timestamp, ts) {
+		cp.pending[worker] = op.Timestamp
+	}
+	cp.leave(op)
+}
+
+// release records that a worker is done with an op that has no points to flush
+func (cp *checkpoint) release(op *gtm.Op) {
+	if !positioned(op) {
+		return
+	}
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	cp.leave(op)
+}
+
+// flush records that worker has written everything up to and including ts
+// and the events of tokens, then persists the new low-water mark
+func (cp *checkpoint) flush(worker int, ts primitive.Timestamp, tokens map[string]*resumeToken) error {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	delete(cp.pending, worker)
+	if tsBefore(cp.flushed, ts) {
+		cp.flushed = ts
+	}
+	if cp.store == nil {
+		return nil
+	}
+	for ns, rt := range tokens {
+		cp.tokens[ns] = append(cp.tokens[ns], rt)
+	}
+	return cp.save()
+}
+
+// advance moves the checkpoint to ts once all points buffered before it are flushed
+func (cp *checkpoint) advance(ts primitive.Timestamp) error {
+	return cp.flush(-1, ts, nil)
+}
+
+func (cp *checkpoint) lowWater() primitive.Timestamp {
+	lw := cp.flushed
+	for _, ts := range cp.pending {
+		if prev := tsPrev(ts); tsBefore(prev, lw) {
+			lw = prev
+		}
+	}
+	for ts := range cp.inflight {
+		if prev := tsPrev(ts); tsBefore(prev, lw) {
+			lw = prev
+		}
+	}
+	return lw
+}
+
+// oldest returns the timestamp of the oldest op received but not flushed, if any
+func (cp *checkpoint) oldest() (ts primitive.Timestamp, ok bool) {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	for _, p := range cp.pending {
+		if !ok || tsBefore(p, ts) {
+			ts, ok = p, true
+		}
+	}
+	for p := range cp.inflight {
+		if !ok || tsBefore(p, ts) {
+			ts, ok = p, true
+		}
+	}
+	return
+}
+
+// save persists the low-water mark if it moved forward. Must be called with the lock held
+func (cp *checkpoint) save() error {
+	lw := cp.lowWater()
+	if lw.T == 0 {
+		return nil
+	}
+	if tsBefore(cp.saved, lw) {
+		if err := cp.store.SaveTimestamp(lw); err != nil {
+			return err
+		}
+		cp.saved = lw
+	}
+	return cp.saveTokens(lw)
+}
+
+// saveTokens persists for each namespace the newest token at or below the low-water mark
+func (cp *checkpoint) saveTokens(lw primitive.Timestamp) error {
+	for ns, candidates := range cp.tokens {
+		var newest *resumeToken
+		var later []*resumeToken
+		for _, rt := range candidates {
+			if tsBefore(lw, rt.ts) {
+				later = append(later, rt)
+			} else if newest == nil || tsBefore(newest.ts, rt.ts) {
+				newest = rt
+			}
+		}
+		if newest == nil {
+			continue
+		}
+		if err := cp.store.SaveToken(newest); err != nil {
+			return err
+		}
+		if len(later) == 0 {
+			delete(cp.tokens, ns)
+		} else {
+			cp.tokens[ns] = later
+		}
+	}
+	return nil
+}
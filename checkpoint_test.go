@@ -0,0 +1,97 @@
+package main
+
+import (
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+)
+
+// memoryStore records the checkpoints saved to it
+type memoryStore struct {
+	saved  []primitive.Timestamp
+	tokens []*resumeToken
+}
+
+func (s *memoryStore) LoadTimestamp() (primitive.Timestamp, error) {
+	if len(s.saved) == 0 {
+		return primitive.Timestamp{}, nil
+	}
+	return s.saved[len(s.saved)-1], nil
+}
+
+func (s *memoryStore) SaveTimestamp(ts primitive.Timestamp) error {
+	s.saved = append(s.saved, ts)
+	return nil
+}
+
+func (s *memoryStore) LoadTokens() (map[string]*resumeToken, error) {
+	return nil, nil
+}
+
+func (s *memoryStore) SaveToken(rt *resumeToken) error {
+	s.tokens = append(s.tokens, rt)
+	return nil
+}
+
+func oplogOp(t uint32) *gtm.Op {
+	return &gtm.Op{Operation: "i", Source: gtm.OplogQuerySource, Timestamp: primitive.Timestamp{T: t, I: 1}}
+}
+
+func TestLowWaterHoldsBackOpInFlight(t *testing.T) {
+	store := &memoryStore{}
+	cp := newCheckpoint(store)
+	early, late := oplogOp(5), oplogOp(10)
+	cp.enter(early)
+	cp.enter(late)
+	// worker 1 buffers and flushes the later op while the earlier one is still queued
+	cp.track(1, late)
+	if err := cp.flush(1, late.Timestamp, nil); err != nil {
+		t.Fatal(err)
+	}
+	if lw := cp.lowWater(); lw != tsPrev(early.Timestamp) {
+		t.Fatalf("expected the low-water mark %+v below the op in flight, got %+v", tsPrev(early.Timestamp), lw)
+	}
+	for _, ts := range store.saved {
+		if !tsBefore(ts, early.Timestamp) {
+			t.Fatalf("saved %+v past the op in flight at %+v", ts, early.Timestamp)
+		}
+	}
+	// worker 2 buffers the earlier op, which still holds back the checkpoint until flushed
+	cp.track(2, early)
+	if lw := cp.lowWater(); lw != tsPrev(early.Timestamp) {
+		t.Fatalf("expected the low-water mark %+v below the buffered op, got %+v", tsPrev(early.Timestamp), lw)
+	}
+	if err := cp.flush(2, early.Timestamp, nil); err != nil {
+		t.Fatal(err)
+	}
+	if lw := cp.lowWater(); lw != late.Timestamp {
+		t.Fatalf("expected the low-water mark at %+v once both ops are flushed, got %+v", late.Timestamp, lw)
+	}
+	if saved, _ := store.LoadTimestamp(); saved != late.Timestamp {
+		t.Fatalf("expected %+v to be saved, got %+v", late.Timestamp, saved)
+	}
+}
+
+func TestLowWaterReleasedOp(t *testing.T) {
+	cp := newCheckpoint(&memoryStore{})
+	skipped, op := oplogOp(5), oplogOp(10)
+	cp.enter(skipped)
+	cp.enter(op)
+	cp.release(skipped)
+	cp.track(1, op)
+	if err := cp.flush(1, op.Timestamp, nil); err != nil {
+		t.Fatal(err)
+	}
+	if lw := cp.lowWater(); lw != op.Timestamp {
+		t.Fatalf("expected a released op not to hold back the low-water mark, got %+v", lw)
+	}
+}
+
+func TestLowWaterIgnoresDirectReads(t *testing.T) {
+	cp := newCheckpoint(&memoryStore{})
+	read := &gtm.Op{Operation: "i", Source: gtm.DirectQuerySource}
+	cp.enter(read)
+	if len(cp.inflight) != 0 {
+		t.Fatalf("expected direct reads not to be in flight, got %v", cp.inflight)
+	}
+}
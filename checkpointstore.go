@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/influxdata/influxdb1-client/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	checkpointMeasurement     = "mongofluxd_checkpoint"
+	checkpointDatabaseDefault = Name
+	resumeCollection          = "resume"
+)
+
+// CheckpointStore persists the resume timestamp and the change stream resume
+// tokens of each namespace under the configured resume name
+type CheckpointStore interface {
+	// LoadTimestamp returns the saved timestamp or a zero timestamp if there is none
+	LoadTimestamp() (primitive.Timestamp, error)
+	SaveTimestamp(ts primitive.Timestamp) error
+	// LoadTokens returns the saved resume tokens keyed by namespace
+	LoadTokens() (map[string]*resumeToken, error)
+	SaveToken(rt *resumeToken) error
+}
+
+// mongoCheckpointStore keeps checkpoints in the source MongoDB in the
+// collections mongofluxd.resume and mongofluxd.tokens
+type mongoCheckpointStore struct {
+	client *mongo.Client
+	name   string
+}
+
+func (s *mongoCheckpointStore) LoadTimestamp() (ts primitive.Timestamp, err error) {
+	col := s.client.Database(Name).Collection(resumeCollection)
+	result := col.FindOne(context.Background(), bson.M{
+		"_id": s.name,
+	})
+	if err = result.Err(); err == nil {
+		doc := make(map[string]interface{})
+		if err = result.Decode(&doc); err == nil {
+			if doc["ts"] != nil {
+				ts = doc["ts"].(primitive.Timestamp)
+			}
+		}
+	}
+	if err == mongo.ErrNoDocuments {
+		err = nil
+	}
+	return
+}
+
+func (s *mongoCheckpointStore) SaveTimestamp(ts primitive.Timestamp) error {
+	col := s.client.Database(Name).Collection(resumeCollection)
+	doc := map[string]interface{}{
+		"ts": ts,
+	}
+	opts := options.Update()
+	opts.SetUpsert(true)
+	_, err := col.UpdateOne(context.Background(), bson.M{
+		"_id": s.name,
+	}, bson.M{
+		"$set": doc,
+	}, opts)
+	return err
+}
+
+func (s *mongoCheckpointStore) LoadTokens() (map[string]*resumeToken, error) {
+	tokens := make(map[string]*resumeToken)
+	col := s.client.Database(Name).Collection(resumeTokenCollection)
+	cursor, err := col.Find(context.Background(), bson.M{"name": s.name})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	for cursor.Next(context.Background()) {
+		doc := make(map[string]interface{})
+		if err = cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		ns, _ := doc["ns"].(string)
+		ts, _ := doc["ts"].(primitive.Timestamp)
+		if ns != "" && doc["token"] != nil {
+			tokens[ns] = &resumeToken{ns: ns, token: doc["token"], ts: ts}
+		}
+	}
+	return tokens, cursor.Err()
+}
+
+func (s *mongoCheckpointStore) SaveToken(rt *resumeToken) error {
+	col := s.client.Database(Name).Collection(resumeTokenCollection)
+	opts := options.Update()
+	opts.SetUpsert(true)
+	_, err := col.UpdateOne(context.Background(), bson.M{
+		"_id": s.name + ":" + rt.ns,
+	}, bson.M{
+		"$set": bson.M{
+			"name":  s.name,
+			"ns":    rt.ns,
+			"token": rt.token,
+			"ts":    rt.ts,
+		},
+	}, opts)
+	return err
+}
+
+// fileCheckpointStore keeps checkpoints in a local file of canonical extended JSON.
+// The file is replaced atomically by writing a temporary file and renaming it
+type fileCheckpointStore struct {
+	lock sync.Mutex
+	path string
+	name string
+	doc  map[string]interface{}
+}
+
+func newFileCheckpointStore(path, name string) (*fileCheckpointStore, error) {
+	s := &fileCheckpointStore{
+		path: path,
+		name: name,
+		doc:  make(map[string]interface{}),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = bson.UnmarshalExtJSON(data, true, &s.doc); err != nil {
+		return nil, fmt.Errorf("Unable to parse checkpoint file %s: %s", path, err)
+	}
+	return s, nil
+}
+
+// entry returns the checkpoint document for the resume name. Must be called with the lock held
+func (s *fileCheckpointStore) entry() map[string]interface{} {
+	e, ok := s.doc[s.name].(map[string]interface{})
+	if !ok {
+		e = make(map[string]interface{})
+		s.doc[s.name] = e
+	}
+	return e
+}
+
+// write replaces the file with the current checkpoints. Must be called with the lock held
+func (s *fileCheckpointStore) write() error {
+	data, err := bson.MarshalExtJSON(s.doc, true, false)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (s *fileCheckpointStore) LoadTimestamp() (primitive.Timestamp, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ts, _ := s.entry()["ts"].(primitive.Timestamp)
+	return ts, nil
+}
+
+func (s *fileCheckpointStore) SaveTimestamp(ts primitive.Timestamp) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.entry()["ts"] = ts
+	return s.write()
+}
+
+func (s *fileCheckpointStore) LoadTokens() (map[string]*resumeToken, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	tokens := make(map[string]*resumeToken)
+	saved, _ := s.entry()["tokens"].(map[string]interface{})
+	for ns, v := range saved {
+		if doc, ok := v.(map[string]interface{}); ok && doc["token"] != nil {
+			ts, _ := doc["ts"].(primitive.Timestamp)
+			tokens[ns] = &resumeToken{ns: ns, token: doc["token"], ts: ts}
+		}
+	}
+	return tokens, nil
+}
+
+func (s *fileCheckpointStore) SaveToken(rt *resumeToken) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e := s.entry()
+	saved, ok := e["tokens"].(map[string]interface{})
+	if !ok {
+		saved = make(map[string]interface{})
+		e["tokens"] = saved
+	}
+	saved[rt.ns] = map[string]interface{}{
+		"token": rt.token,
+		"ts":    rt.ts,
+	}
+	return s.write()
+}
+
+// influxCheckpointStore keeps checkpoints as points of the mongofluxd_checkpoint
+// measurement in the target InfluxDB 1.X. Every checkpoint is written at the
+// same time so that each save overwrites the previous one
+type influxCheckpointStore struct {
+	c        client.Client
+	database string
+	name     string
+}
+
+func (s *influxCheckpointStore) write(tags map[string]string, fields map[string]interface{}) error {
+	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
+		Database:  s.database,
+		Precision: "s",
+	})
+	if err != nil {
+		return err
+	}
+	tags["name"] = s.name
+	pt, err := client.NewPoint(checkpointMeasurement, tags, fields, time.Unix(0, 0))
+	if err != nil {
+		return err
+	}
+	bp.AddPoint(pt)
+	return s.c.Write(bp)
+}
+
+func (s *influxCheckpointStore) query() ([]map[string]interface{}, error) {
+	q := client.NewQuery(fmt.Sprintf(`SELECT * FROM "%s" WHERE "name" = '%s'`,
+		checkpointMeasurement, strings.Replace(s.name, "'", `\'`, -1)), s.database, "s")
+	response, err := s.c.Query(q)
+	if err != nil {
+		return nil, err
+	} else if err = response.Error(); err != nil {
+		if strings.Contains(err.Error(), "database not found") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var rows []map[string]interface{}
+	for _, result := range response.Results {
+		for _, series := range result.Series {
+			for _, values := range series.Values {
+				row := make(map[string]interface{})
+				for i, col := range series.Columns {
+					row[col] = values[i]
+				}
+				rows = append(rows, row)
+			}
+		}
+	}
+	return rows, nil
+}
+
+func influxUint32(v interface{}) uint32 {
+	if n, ok := v.(json.Number); ok {
+		i, _ := strconv.ParseUint(n.String(), 10, 32)
+		return uint32(i)
+	}
+	return 0
+}
+
+func (s *influxCheckpointStore) LoadTimestamp() (ts primitive.Timestamp, err error) {
+	rows, err := s.query()
+	for _, row := range rows {
+		if row["ns"] == nil {
+			ts.T = influxUint32(row["t"])
+			ts.I = influxUint32(row["i"])
+		}
+	}
+	return
+}
+
+func (s *influxCheckpointStore) SaveTimestamp(ts primitive.Timestamp) error {
+	return s.write(map[string]string{}, map[string]interface{}{
+		"t": int64(ts.T),
+		"i": int64(ts.I),
+	})
+}
+
+func (s *influxCheckpointStore) LoadTokens() (map[string]*resumeToken, error) {
+	rows, err := s.query()
+	if err != nil {
+		return nil, err
+	}
+	tokens := make(map[string]*resumeToken)
+	for _, row := range rows {
+		ns, _ := row["ns"].(string)
+		data, _ := row["token"].(string)
+		if ns == "" || data == "" {
+			continue
+		}
+		var doc map[string]interface{}
+		if err = bson.UnmarshalExtJSON([]byte(data), true, &doc); err != nil {
+			return nil, err
+		}
+		tokens[ns] = &resumeToken{
+			ns:    ns,
+			token: doc["token"],
+			ts:    primitive.Timestamp{T: influxUint32(row["t"]), I: influxUint32(row["i"])},
+		}
+	}
+	return tokens, nil
+}
+
+func (s *influxCheckpointStore) SaveToken(rt *resumeToken) error {
+	data, err := bson.MarshalExtJSON(bson.M{"token": rt.token}, true, false)
+	if err != nil {
+		return err
+	}
+	return s.write(map[string]string{"ns": rt.ns}, map[string]interface{}{
+		"t":     int64(rt.ts.T),
+		"i":     int64(rt.ts.I),
+		"token": string(data),
+	})
+}
+
+func (config *configOptions) newInfluxCheckpointStore() (CheckpointStore, error) {
+	if config.InfluxToken != "" || config.InfluxOrg != "" {
+		return nil, fmt.Errorf("The influx resume store requires InfluxDB 1.X")
+	}
+	httpConfig, err := config.influxHTTPConfig()
+	if err != nil {
+		return nil, err
+	}
+	c, err := client.NewHTTPClient(httpConfig)
+	if err != nil {
+		return nil, err
+	}
+	s := &influxCheckpointStore{
+		c:        c,
+		database: checkpointDatabaseDefault,
+		name:     config.ResumeName,
+	}
+	if config.DryRun {
+		// a dry run only reads the saved position, which is missing until the database exists
+		return s, nil
+	}
+	q := client.NewQuery(fmt.Sprintf(`CREATE DATABASE "%s"`, s.database), "", "")
+	if response, err := c.Query(q); err != nil {
+		return nil, err
+	} else if err = response.Error(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewCheckpointStore creates the store selected by the resume-store option:
+// mongo (default), file:/path or influx
+func (config *configOptions) NewCheckpointStore(mongoClient *mongo.Client) (CheckpointStore, error) {
+	if err := config.checkResumeStore(); err != nil {
+		return nil, err
+	}
+	store := config.ResumeStore
+	if strings.HasPrefix(store, "file:") {
+		return newFileCheckpointStore(strings.TrimPrefix(store, "file:"), config.ResumeName)
+	} else if store == "influx" {
+		return config.newInfluxCheckpointStore()
+	}
+	return &mongoCheckpointStore{client: mongoClient, name: config.ResumeName}, nil
+}
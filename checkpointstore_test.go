@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInfluxCheckpointStoreDryRunCreatesNothing(t *testing.T) {
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		queries = append(queries, r.Form.Get("q"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"results":[{"statement_id":0,"error":"database not found: mongofluxd"}]}`))
+	}))
+	defer srv.Close()
+	config := newConfig()
+	config.InfluxURL = srv.URL
+	config.ResumeStore = "influx"
+	config.DryRun = true
+	store, err := config.NewCheckpointStore(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.LoadTimestamp(); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range queries {
+		if strings.HasPrefix(q, "CREATE") {
+			t.Fatalf("expected no database to be created in a dry run, got %q", q)
+		}
+	}
+	if len(queries) != 1 {
+		t.Fatalf("expected the saved position to be read, got %v", queries)
+	}
+}
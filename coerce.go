@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	fieldTypeFloat  = "float"
+	fieldTypeInt    = "int"
+	fieldTypeString = "string"
+	fieldTypeBool   = "bool"
+)
+
+func validFieldType(typ string) bool {
+	switch typ {
+	case fieldTypeFloat, fieldTypeInt, fieldTypeString, fieldTypeBool:
+		return true
+	default:
+		return false
+	}
+}
+
+// coerceField converts a document value to the type declared for a field.
+// Dates are converted to milliseconds since the epoch
+func coerceField(v interface{}, typ string) (interface{}, error) {
+	var (
+		out interface{}
+		err error
+	)
+	switch typ {
+	case fieldTypeFloat:
+		out, err = toFloat(v)
+	case fieldTypeInt:
+		out, err = toInt(v)
+	case fieldTypeString:
+		out, err = toString(v)
+	case fieldTypeBool:
+		out, err = toBool(v)
+	default:
+		return nil, fmt.Errorf("unsupported field type %s", typ)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to convert %T %v to %s: %s", v, v, typ, err)
+	}
+	return out, nil
+}
+
+func finite(f float64) (float64, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("%v cannot be written to InfluxDB", f)
+	}
+	return f, nil
+}
+
+func toFloat(v interface{}) (float64, error) {
+	switch vt := v.(type) {
+	case float64:
+		return finite(vt)
+	case float32:
+		return finite(float64(vt))
+	case int:
+		return float64(vt), nil
+	case int32:
+		return float64(vt), nil
+	case int64:
+		return float64(vt), nil
+	case bool:
+		if vt {
+			return 1, nil
+		}
+		return 0, nil
+	case primitive.Decimal128:
+		f, err := strconv.ParseFloat(vt.String(), 64)
+		if err != nil {
+			return 0, err
+		}
+		return finite(f)
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(vt), 64)
+		if err != nil {
+			return 0, err
+		}
+		return finite(f)
+	default:
+		return 0, fmt.Errorf("unsupported type")
+	}
+}
+
+func toInt(v interface{}) (int64, error) {
+	switch vt := v.(type) {
+	case int:
+		return int64(vt), nil
+	case int32:
+		return int64(vt), nil
+	case int64:
+		return vt, nil
+	case bool:
+		if vt {
+			return 1, nil
+		}
+		return 0, nil
+	case time.Time:
+		return vt.UnixNano() / int64(time.Millisecond), nil
+	case primitive.DateTime:
+		return int64(vt), nil
+	case string:
+		s := strings.TrimSpace(vt)
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, nil
+		}
+		f, err := toFloat(s)
+		if err != nil {
+			return 0, err
+		}
+		return wholeInt(f)
+	default:
+		f, err := toFloat(v)
+		if err != nil {
+			return 0, err
+		}
+		return wholeInt(f)
+	}
+}
+
+func wholeInt(f float64) (int64, error) {
+	if f != math.Trunc(f) {
+		return 0, fmt.Errorf("%v is not a whole number", f)
+	}
+	if f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, fmt.Errorf("%v is out of range", f)
+	}
+	return int64(f), nil
+}
+
+func toString(v interface{}) (string, error) {
+	switch vt := v.(type) {
+	case string:
+		return vt, nil
+	case primitive.ObjectID:
+		return vt.Hex(), nil
+	case primitive.Decimal128:
+		return vt.String(), nil
+	case time.Time:
+		return vt.UTC().Format(time.RFC3339Nano), nil
+	case primitive.DateTime:
+		return time.Unix(0, int64(vt)*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano), nil
+	case int:
+		return strconv.Itoa(vt), nil
+	case int32:
+		return strconv.FormatInt(int64(vt), 10), nil
+	case int64:
+		return strconv.FormatInt(vt, 10), nil
+	case float32:
+		return strconv.FormatFloat(float64(vt), 'g', -1, 32), nil
+	case float64:
+		return strconv.FormatFloat(vt, 'g', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(vt), nil
+	default:
+		return "", fmt.Errorf("unsupported type")
+	}
+}
+
+func toBool(v interface{}) (bool, error) {
+	switch vt := v.(type) {
+	case bool:
+		return vt, nil
+	case string:
+		return strconv.ParseBool(strings.TrimSpace(vt))
+	case int:
+		return vt != 0, nil
+	case int32:
+		return vt != 0, nil
+	case int64:
+		return vt != 0, nil
+	default:
+		return false, fmt.Errorf("unsupported type")
+	}
+}
+
+// formatTag converts a document value to a tag value. For Dates layout is a
+// time layout and defaults to RFC3339, for other values it is an optional fmt verb
+func formatTag(v interface{}, layout string) (string, error) {
+	switch vt := v.(type) {
+	case time.Time:
+		if layout == "" {
+			layout = time.RFC3339Nano
+		}
+		return vt.UTC().Format(layout), nil
+	case primitive.DateTime:
+		return formatTag(time.Unix(0, int64(vt)*int64(time.Millisecond)), layout)
+	case string, primitive.ObjectID, primitive.Decimal128, bool, int, int32, int64, float32, float64:
+		if layout == "" {
+			return toString(v)
+		}
+		s := fmt.Sprintf(layout, v)
+		if strings.Contains(s, "%!") && !strings.Contains(fmt.Sprint(v), "%!") {
+			// fmt reports a verb that does not suit the value in the output
+			return "", fmt.Errorf("format %q does not suit %T %v", layout, v, v)
+		}
+		return s, nil
+	default:
+		return "", fmt.Errorf("unsupported type %T", v)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestFormatTag(t *testing.T) {
+	date := time.Date(2019, 5, 10, 14, 30, 0, 0, time.UTC)
+	oid, _ := primitive.ObjectIDFromHex("5cd58b2d3c2e4a1b2c3d4e5f")
+	tests := []struct {
+		name   string
+		v      interface{}
+		layout string
+		want   string
+		valid  bool
+	}{
+		{"string", "abc", "", "abc", true},
+		{"object id", oid, "", "5cd58b2d3c2e4a1b2c3d4e5f", true},
+		{"int verb", 42, "%05d", "00042", true},
+		{"float verb", 1.5, "%.2f", "1.50", true},
+		{"string verb", "abc", "id-%s", "id-abc", true},
+		{"percent in value", "50%!", "%s", "50%!", true},
+		{"date default", date, "", "2019-05-10T14:30:00Z", true},
+		{"date layout", date, "2006-01", "2019-05", true},
+		{"bson date", primitive.DateTime(date.UnixNano() / int64(time.Millisecond)), "2006", "2019", true},
+		{"wrong verb", "abc", "%d", "", false},
+		{"date layout on bool", true, "2006", "", false},
+		{"missing argument", 1, "%d-%d", "", false},
+		{"unsupported type", []interface{}{1}, "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := formatTag(tt.v, tt.layout)
+			if (err == nil) != tt.valid {
+				t.Fatalf("expected valid %v, got %q, %v", tt.valid, got, err)
+			}
+			if got != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCoerceField(t *testing.T) {
+	date := time.Date(2019, 5, 10, 14, 30, 0, 123000000, time.UTC)
+	ms := date.UnixNano() / int64(time.Millisecond)
+	dec, _ := primitive.ParseDecimal128("12.50")
+	tests := []struct {
+		name  string
+		v     interface{}
+		typ   string
+		want  interface{}
+		valid bool
+	}{
+		{"int to float", 3, "float", 3.0, true},
+		{"decimal to float", dec, "float", 12.5, true},
+		{"string to float", " 1.25 ", "float", 1.25, true},
+		{"bool to float", true, "float", 1.0, true},
+		{"nan", math.NaN(), "float", nil, false},
+		{"inf string", "+Inf", "float", nil, false},
+		{"float to int", 4.0, "int", int64(4), true},
+		{"fraction to int", 4.5, "int", nil, false},
+		{"string to int", "42", "int", int64(42), true},
+		{"float string to int", "42.0", "int", int64(42), true},
+		{"date to int", date, "int", ms, true},
+		{"bson date to int", primitive.DateTime(ms), "int", ms, true},
+		{"int overflow", 1e19, "int", nil, false},
+		{"int underflow", -1e19, "int", nil, false},
+		{"max int64 string", "9223372036854775807", "int", int64(math.MaxInt64), true},
+		{"int64 overflow string", "9223372036854775808", "int", nil, false},
+		{"date to string", date, "string", "2019-05-10T14:30:00.123Z", true},
+		{"bson date to string", primitive.DateTime(ms), "string", "2019-05-10T14:30:00.123Z", true},
+		{"float to string", 0.1, "string", "0.1", true},
+		{"int to string", int32(7), "string", "7", true},
+		{"string to bool", "true", "bool", true, true},
+		{"int to bool", int64(0), "bool", false, true},
+		{"text to bool", "maybe", "bool", nil, false},
+		{"document", map[string]interface{}{}, "float", nil, false},
+		{"unknown type", 1, "decimal", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := coerceField(tt.v, tt.typ)
+			if (err == nil) != tt.valid {
+				t.Fatalf("expected valid %v, got %v, %v", tt.valid, got, err)
+			}
+			if got != tt.want {
+				t.Fatalf("expected %T %v, got %T %v", tt.want, tt.want, got, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// flagOptions maps the flags not named after their option
+var flagOptions = map[string]string{
+	"f": "configfile",
+	"v": "version",
+}
+
+const measurementFlagPrefix = "measurement."
+
+// newConfig returns the configuration holding the defaults
+func newConfig() *configOptions {
+	return &configOptions{
+		GtmSettings:        GtmDefaultSettings(),
+		RetrySettings:      RetryDefaultSettings(),
+		InfluxAutoCreateDB: true,
+	}
+}
+
+// optionField returns the field of v, a struct, set by the option at the dotted path
+func optionField(v reflect.Value, path string) (reflect.Value, bool) {
+	for _, name := range strings.Split(path, ".") {
+		if v.Kind() != reflect.Struct {
+			return reflect.Value{}, false
+		}
+		t := v.Type()
+		found := false
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.PkgPath == "" && optionName(f) == name {
+				v, found = v.Field(i), true
+				break
+			}
+		}
+		if !found {
+			return reflect.Value{}, false
+		}
+	}
+	return v, true
+}
+
+// applyFlags copies the options of the flags given on the command line from flags
+func (config *configOptions) applyFlags(flags *configOptions, given map[string]bool) error {
+	dst, src := reflect.ValueOf(config).Elem(), reflect.ValueOf(flags).Elem()
+	measured := false
+	for name := range given {
+		if strings.HasPrefix(name, measurementFlagPrefix) {
+			measured = true
+			continue
+		}
+		option := name
+		if o, ok := flagOptions[name]; ok {
+			option = o
+		}
+		to, ok := optionField(dst, option)
+		if !ok {
+			return fmt.Errorf("flag -%s does not set an option", name)
+		}
+		from, _ := optionField(src, option)
+		to.Set(from)
+	}
+	if measured {
+		config.cliMeasurement = flags.cliMeasurement
+		config.Measurement = append(config.Measurement, flags.cliMeasurement)
+	}
+	return nil
+}
+
+// stringList is a flag taking a comma separated list which may be repeated
+type stringList struct {
+	values *[]string
+}
+
+func (l stringList) String() string {
+	if l.values == nil {
+		return ""
+	}
+	return strings.Join(*l.values, ",")
+}
+
+func (l stringList) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l.values = append(*l.values, v)
+		}
+	}
+	return nil
+}
+
+// measurementFlags defines a flag for each setting of a measurement, e.g.
+// -measurement.namespace, so that a single measurement can be given without
+// a configuration file
+func (config *configOptions) measurementFlags() {
+	config.cliMeasurement = &measureSettings{}
+	v := reflect.ValueOf(config.cliMeasurement).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := measurementFlagPrefix + optionName(f)
+		switch p := v.Field(i).Addr().Interface().(type) {
+		case *string:
+			flag.StringVar(p, name, "", fmt.Sprintf("The %s of a measurement given on the command line", optionName(f)))
+		case *[]string:
+			flag.Var(stringList{p}, name, fmt.Sprintf("The %s of a measurement given on the command line, comma separated", optionName(f)))
+		}
+	}
+}
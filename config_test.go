@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "mongofluxd.toml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// givenFlags returns flags as if each of names was given on the command line
+func givenFlags(flags *configOptions, names ...string) *configOptions {
+	flags.given = map[string]bool{"f": true}
+	for _, name := range names {
+		flags.given[name] = true
+	}
+	return flags
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	const measurement = `
+[[measurement]]
+namespace = "db.col"
+fields = ["v"]
+`
+	tests := []struct {
+		name   string
+		file   string
+		env    map[string]string
+		flags  *configOptions
+		given  []string
+		verify func(t *testing.T, config *configOptions)
+	}{
+		{
+			name:  "given flag overrides file",
+			file:  "influx-auto-create-db = true",
+			flags: &configOptions{InfluxAutoCreateDB: false},
+			given: []string{"influx-auto-create-db"},
+			verify: func(t *testing.T, config *configOptions) {
+				if config.InfluxAutoCreateDB {
+					t.Fatal("expected -influx-auto-create-db=false to override the file")
+				}
+			},
+		},
+		{
+			name: "env overrides file",
+			file: `influx-url = "http://file:8086"`,
+			env:  map[string]string{"MONGOFLUXD_INFLUX_URL": "http://env:8086"},
+			verify: func(t *testing.T, config *configOptions) {
+				if config.InfluxURL != "http://env:8086" {
+					t.Fatalf("expected the environment to override the file, got %s", config.InfluxURL)
+				}
+			},
+		},
+		{
+			name:  "flag overrides env",
+			file:  `influx-url = "http://file:8086"`,
+			env:   map[string]string{"MONGOFLUXD_INFLUX_URL": "http://env:8086"},
+			flags: &configOptions{InfluxURL: "http://flag:8086"},
+			given: []string{"influx-url"},
+			verify: func(t *testing.T, config *configOptions) {
+				if config.InfluxURL != "http://flag:8086" {
+					t.Fatalf("expected the flag to override the environment, got %s", config.InfluxURL)
+				}
+			},
+		},
+		{
+			name:  "measurement flags append a measurement",
+			file:  measurement,
+			flags: &configOptions{cliMeasurement: &measureSettings{Namespace: "db.cli", Fields: []string{"n"}}},
+			given: []string{"measurement.namespace", "measurement.fields"},
+			verify: func(t *testing.T, config *configOptions) {
+				if len(config.Measurement) != 2 {
+					t.Fatalf("expected the measurement of the flags to be appended, got %d measurements", len(config.Measurement))
+				}
+				if ns := config.Measurement[1].Namespace; ns != "db.cli" {
+					t.Fatalf("expected the appended measurement for db.cli, got %s", ns)
+				}
+			},
+		},
+		{
+			name:  "ungiven flags keep file values",
+			file:  "influx-auto-create-db = false\ninflux-url = \"http://file:8086\"\ninflux-clients = 3",
+			flags: &configOptions{InfluxAutoCreateDB: true},
+			verify: func(t *testing.T, config *configOptions) {
+				if config.InfluxAutoCreateDB || config.InfluxURL != "http://file:8086" || config.InfluxClients != 3 {
+					t.Fatalf("expected the file values to be kept, got %t %s %d",
+						config.InfluxAutoCreateDB, config.InfluxURL, config.InfluxClients)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			flags := tt.flags
+			if flags == nil {
+				flags = &configOptions{}
+			}
+			flags.ConfigFile = writeConfigFile(t, tt.file)
+			config := newConfig()
+			if _, err := config.load(givenFlags(flags, tt.given...)); err != nil {
+				t.Fatal(err)
+			}
+			tt.verify(t, config)
+		})
+	}
+}
+
+func TestLoadConfigFileFromEnv(t *testing.T) {
+	t.Setenv("MONGOFLUXD_CONFIG_FILE", writeConfigFile(t, `influx-url = "http://file:8086"`))
+	config := newConfig()
+	if _, err := config.load(&configOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if config.InfluxURL != "http://file:8086" {
+		t.Fatalf("expected the file named by MONGOFLUXD_CONFIG_FILE to be read, got %q", config.InfluxURL)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const deadLetterCollection = "deadletter"
+
+// DeadLetter captures documents that could not be mapped to points so that
+// they can be fixed and reprocessed
+type DeadLetter interface {
+	Add(rec *deadLetterRecord) error
+	Close() error
+}
+
+type deadLetterRecord struct {
+	Namespace string                 `bson:"ns"`
+	DocId     interface{}            `bson:"docId"`
+	Operation string                 `bson:"op"`
+	Timestamp primitive.Timestamp    `bson:"ts"`
+	Error     string                 `bson:"error"`
+	Doc       map[string]interface{} `bson:"doc"`
+	Time      time.Time              `bson:"time"`
+}
+
+func newDeadLetterRecord(op *gtm.Op, err error) *deadLetterRecord {
+	return &deadLetterRecord{
+		Namespace: op.Namespace,
+		DocId:     op.Id,
+		Operation: op.Operation,
+		Timestamp: op.Timestamp,
+		Error:     err.Error(),
+		Doc:       op.Data,
+		Time:      time.Now().UTC(),
+	}
+}
+
+// mongoDeadLetter inserts records into the deadletter collection of the mongofluxd database
+type mongoDeadLetter struct {
+	col *mongo.Collection
+}
+
+func (d *mongoDeadLetter) Add(rec *deadLetterRecord) error {
+	_, err := d.col.InsertOne(context.Background(), rec)
+	return err
+}
+
+func (d *mongoDeadLetter) Close() error {
+	return nil
+}
+
+// fileDeadLetter appends records as relaxed extended JSON, one per line
+type fileDeadLetter struct {
+	lock sync.Mutex
+	f    *os.File
+}
+
+func (d *fileDeadLetter) Add(rec *deadLetterRecord) error {
+	data, err := bson.MarshalExtJSON(rec, false, false)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	_, err = d.f.Write(data)
+	return err
+}
+
+func (d *fileDeadLetter) Close() error {
+	return d.f.Close()
+}
+
+// NewDeadLetter creates the dead letter destination from the dead-letter option
+// which is either mongo or file:/path. It returns nil if dead letters are disabled
+func (config *configOptions) NewDeadLetter(client *mongo.Client) (DeadLetter, error) {
+	if err := config.checkDeadLetter(); err != nil {
+		return nil, err
+	}
+	dl := config.DeadLetter
+	if dl == "" {
+		return nil, nil
+	} else if dl == "mongo" {
+		return &mongoDeadLetter{col: client.Database(Name).Collection(deadLetterCollection)}, nil
+	}
+	f, err := os.OpenFile(strings.TrimPrefix(dl, "file:"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileDeadLetter{f: f}, nil
+}
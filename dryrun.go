@@ -0,0 +1,47 @@
+package main
+
+import (
+	"github.com/influxdata/influxdb1-client/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// dryRunSink logs the line protocol of the points it is given instead of writing them
+type dryRunSink struct{}
+
+func (s *dryRunSink) Write(bp client.BatchPoints) error {
+	bucket := influxV2Bucket(bp.Database(), bp.RetentionPolicy())
+	for _, p := range bp.Points() {
+		if p == nil {
+			continue
+		}
+		infoLog.Printf("dry-run write to %s: %s", bucket, p.PrecisionString(bp.Precision()))
+	}
+	return nil
+}
+
+func (s *dryRunSink) CreateDatabase(db, rp string) error {
+	infoLog.Printf("dry-run create database %s", influxV2Bucket(db, rp))
+	return nil
+}
+
+func (s *dryRunSink) DeleteSeries(db, rp, measurement string, tags map[string]string) error {
+	infoLog.Printf("dry-run on %s: %s", influxV2Bucket(db, rp), influxQLDelete(measurement, tags))
+	return nil
+}
+
+func (s *dryRunSink) Close() error {
+	return nil
+}
+
+// dryRunStore resumes from the saved position but does not move it
+type dryRunStore struct {
+	CheckpointStore
+}
+
+func (s *dryRunStore) SaveTimestamp(ts primitive.Timestamp) error {
+	return nil
+}
+
+func (s *dryRunStore) SaveToken(rt *resumeToken) error {
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const envPrefix = "MONGOFLUXD_"
+
+// envRef matches ${NAME}. Other uses of $, as in the operators of filters, are left alone
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces each ${NAME} in s with the value of the environment variable NAME
+func expandEnv(s string) (string, error) {
+	var err error
+	expanded := envRef.ReplaceAllStringFunc(s, func(ref string) string {
+		name := envRef.FindStringSubmatch(ref)[1]
+		v, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return v
+	})
+	return expanded, err
+}
+
+// optionName returns the name of the option set by a struct field in the configuration file
+func optionName(f reflect.StructField) string {
+	if tag := f.Tag.Get("toml"); tag != "" {
+		return tag
+	}
+	return strings.ToLower(f.Name)
+}
+
+// expandStrings expands the environment variables referenced in the strings of
+// the settings in v, including those of measurements
+func expandStrings(v reflect.Value, path string) error {
+	switch v.Kind() {
+	case reflect.String:
+		s, err := expandEnv(v.String())
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		v.SetString(s)
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := expandStrings(v.Index(i), path); err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return expandStrings(v.Elem(), path)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			name := optionName(f)
+			if path != "" {
+				name = path + "." + name
+			}
+			if err := expandStrings(v.Field(i), name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// envName returns the environment variable for an option, e.g. MONGOFLUXD_GTM_SETTINGS_CHANNEL_SIZE
+// for channel-size in gtm-settings
+func envName(option string) string {
+	return envPrefix + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(option))
+}
+
+// setFromString parses s into the option v
+func setFromString(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("cannot be set from the environment")
+	}
+	return nil
+}
+
+// applyEnv sets the options in v given as environment variables
+func applyEnv(v reflect.Value, path string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Name == "Version" || f.Name == "ConfigFile" || f.Name == "Measurement" {
+			continue
+		}
+		name := optionName(f)
+		if path != "" {
+			name = path + "." + name
+		}
+		if f.Type.Kind() == reflect.Struct {
+			if err := applyEnv(v.Field(i), name); err != nil {
+				return err
+			}
+			continue
+		}
+		s, ok := os.LookupEnv(envName(name))
+		if !ok {
+			continue
+		}
+		if err := setFromString(v.Field(i), s); err != nil {
+			return fmt.Errorf("Invalid value %q for %s: %s", s, envName(name), err)
+		}
+	}
+	return nil
+}
+
+// loadEnv sets the options given as MONGOFLUXD_* environment variables
+func (config *configOptions) loadEnv() error {
+	return applyEnv(reflect.ValueOf(config).Elem(), "")
+}
+
+func readSecretFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// secretOptions can also be read from a file given with the option of the same name suffixed by -file
+var secretOptions = []string{"mongo-url", "influx-password", "influx-token"}
+
+// loadSecretFiles reads the secrets given as files, such as mounted Kubernetes
+// secrets, by one layer of the configuration. set reports whether the layer
+// sets an option. A secret file replaces the value given by earlier layers and
+// a layer cannot give both the secret and its file
+func (config *configOptions) loadSecretFiles(layer string, set func(option string) bool) error {
+	v := reflect.ValueOf(config).Elem()
+	for _, option := range secretOptions {
+		file := option + "-file"
+		path, _ := optionField(v, file)
+		if !set(file) || path.String() == "" {
+			continue
+		}
+		if set(option) {
+			return fmt.Errorf("%s and %s cannot both be given in %s", option, file, layer)
+		}
+		secret, err := readSecretFile(path.String())
+		if err != nil {
+			return fmt.Errorf("Unable to read secret file: %s", err)
+		}
+		value, _ := optionField(v, option)
+		value.SetString(secret)
+	}
+	return nil
+}
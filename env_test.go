@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func writeSecret(t *testing.T, secret string) string {
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := ioutil.WriteFile(path, []byte(secret+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func setIn(options ...string) func(string) bool {
+	return func(option string) bool {
+		for _, o := range options {
+			if o == option {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func TestSecretFileReplacesEarlierLayer(t *testing.T) {
+	config := newConfig()
+	config.InfluxPassword = "from-config"
+	if err := config.loadSecretFiles("config.toml", setIn("influx-password")); err != nil {
+		t.Fatal(err)
+	}
+	config.InfluxPasswordFile = writeSecret(t, "from-env-file")
+	if err := config.loadSecretFiles("the environment", setIn("influx-password-file")); err != nil {
+		t.Fatal(err)
+	}
+	if config.InfluxPassword != "from-env-file" {
+		t.Fatalf("expected the secret file of the environment to be read, got %q", config.InfluxPassword)
+	}
+}
+
+func TestSecretValueReplacesEarlierFile(t *testing.T) {
+	config := newConfig()
+	config.MongoURLFile = writeSecret(t, "mongodb://from-file")
+	if err := config.loadSecretFiles("config.toml", setIn("mongo-url-file")); err != nil {
+		t.Fatal(err)
+	}
+	config.MongoURL = "mongodb://from-flag"
+	if err := config.loadSecretFiles("the flags", setIn("mongo-url")); err != nil {
+		t.Fatal(err)
+	}
+	if config.MongoURL != "mongodb://from-flag" {
+		t.Fatalf("expected the flag to replace the secret file, got %q", config.MongoURL)
+	}
+}
+
+func TestSecretAndFileInOneLayer(t *testing.T) {
+	config := newConfig()
+	config.InfluxToken = "token"
+	config.InfluxTokenFile = writeSecret(t, "token-from-file")
+	if err := config.loadSecretFiles("the environment", setIn("influx-token", "influx-token-file")); err == nil {
+		t.Fatal("expected an error when a layer gives both the secret and its file")
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"fmt"
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// docMatcher reports whether a document matches a measurement filter
+type docMatcher func(doc map[string]interface{}) bool
+
+// compileFilters parses the filter of each measurement. Filters are MongoDB
+// query documents in extended JSON which are evaluated against change events
+// and pushed down as the query of direct reads
+func (config *configOptions) compileFilters() error {
+	for _, m := range config.Measurement {
+		if m.Filter == "" {
+			continue
+		}
+		var query bson.M
+		if err := bson.UnmarshalExtJSON([]byte(m.Filter), false, &query); err != nil {
+			return fmt.Errorf("Invalid filter for %s: %s", m.pattern(), err)
+		}
+		match, err := compileQuery(query)
+		if err != nil {
+			return fmt.Errorf("Invalid filter for %s: %s", m.pattern(), err)
+		}
+		m.query, m.match = query, match
+	}
+	return nil
+}
+
+// filterPipe pushes the filters of the measurements of a namespace down to direct
+// reads of it. Nothing is pushed down if one of the measurements has no filter
+func (config *configOptions) filterPipe() gtm.PipelineBuilder {
+	filtered := false
+	for _, m := range config.Measurement {
+		if m.query != nil {
+			filtered = true
+		}
+	}
+	if !filtered {
+		return nil
+	}
+	return func(ns string, changeStream bool) ([]interface{}, error) {
+		if changeStream {
+			return nil, nil
+		}
+		var queries []interface{}
+		for _, m := range config.Measurement {
+			if !m.matches(ns) {
+				continue
+			}
+			if m.query == nil {
+				return nil, nil
+			}
+			queries = append(queries, m.query)
+		}
+		switch len(queries) {
+		case 0:
+			return nil, nil
+		case 1:
+			return []interface{}{bson.M{"$match": queries[0]}}, nil
+		default:
+			return []interface{}{bson.M{"$match": bson.M{"$or": queries}}}, nil
+		}
+	}
+}
+
+func asDoc(v interface{}) (map[string]interface{}, bool) {
+	switch d := v.(type) {
+	case map[string]interface{}:
+		return d, true
+	case primitive.M:
+		return map[string]interface{}(d), true
+	case primitive.D:
+		return d.Map(), true
+	default:
+		return nil, false
+	}
+}
+
+func allMatch(matchers []docMatcher) docMatcher {
+	return func(doc map[string]interface{}) bool {
+		for _, m := range matchers {
+			if !m(doc) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func compileQuery(query map[string]interface{}) (docMatcher, error) {
+	var matchers []docMatcher
+	for k, v := range query {
+		var m docMatcher
+		var err error
+		switch k {
+		case "$and", "$or", "$nor":
+			m, err = compileLogical(k, v)
+		default:
+			if strings.HasPrefix(k, "$") {
+				return nil, fmt.Errorf("unsupported operator %s", k)
+			}
+			m, err = compileField(k, v)
+		}
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return allMatch(matchers), nil
+}
+
+func compileLogical(op string, v interface{}) (docMatcher, error) {
+	clauses, ok := asArray(v)
+	if !ok || len(clauses) == 0 {
+		return nil, fmt.Errorf("%s requires a non empty array", op)
+	}
+	var matchers []docMatcher
+	for _, c := range clauses {
+		q, ok := asDoc(c)
+		if !ok {
+			return nil, fmt.Errorf("%s requires an array of documents", op)
+		}
+		m, err := compileQuery(q)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	if op == "$and" {
+		return allMatch(matchers), nil
+	}
+	return func(doc map[string]interface{}) bool {
+		for _, m := range matchers {
+			if m(doc) {
+				return op == "$or"
+			}
+		}
+		return op == "$nor"
+	}, nil
+}
+
+// isOperatorDoc reports whether every key of a condition is an operator
+func isOperatorDoc(cond map[string]interface{}) bool {
+	if len(cond) == 0 {
+		return false
+	}
+	for k := range cond {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+func compileField(path string, cond interface{}) (docMatcher, error) {
+	c, ok := asDoc(cond)
+	if !ok || !isOperatorDoc(c) {
+		if re, ok := cond.(primitive.Regex); ok {
+			return compileRegex(path, re.Pattern, re.Options)
+		}
+		return fieldMatcher(path, func(v interface{}, found bool) bool {
+			return valueEquals(v, found, cond)
+		}), nil
+	}
+	var matchers []docMatcher
+	for op, arg := range c {
+		var m docMatcher
+		var err error
+		switch op {
+		case "$eq", "$ne":
+			eq := fieldMatcher(path, func(v interface{}, found bool) bool {
+				return valueEquals(v, found, arg)
+			})
+			m = eq
+			if op == "$ne" {
+				m = func(doc map[string]interface{}) bool { return !eq(doc) }
+			}
+		case "$gt", "$gte", "$lt", "$lte":
+			m = compileCompare(path, op, arg)
+		case "$in", "$nin":
+			values, ok := asArray(arg)
+			if !ok {
+				return nil, fmt.Errorf("%s requires an array", op)
+			}
+			in := fieldMatcher(path, func(v interface{}, found bool) bool {
+				for _, want := range values {
+					if valueEquals(v, found, want) {
+						return true
+					}
+				}
+				return false
+			})
+			m = in
+			if op == "$nin" {
+				m = func(doc map[string]interface{}) bool { return !in(doc) }
+			}
+		case "$exists":
+			want := truthy(arg)
+			m = func(doc map[string]interface{}) bool {
+				return (len(pathValues(doc, path)) > 0) == want
+			}
+		case "$not":
+			var not docMatcher
+			if re, ok := arg.(primitive.Regex); ok {
+				not, err = compileRegex(path, re.Pattern, re.Options)
+			} else if q, ok := asDoc(arg); ok && isOperatorDoc(q) {
+				not, err = compileField(path, q)
+			} else {
+				err = fmt.Errorf("$not requires an operator document or regex")
+			}
+			m = func(doc map[string]interface{}) bool { return !not(doc) }
+		case "$regex":
+			var pattern, options string
+			switch re := arg.(type) {
+			case string:
+				pattern = re
+			case primitive.Regex:
+				pattern, options = re.Pattern, re.Options
+			default:
+				return nil, fmt.Errorf("$regex requires a string")
+			}
+			if o, ok := c["$options"].(string); ok {
+				options = o
+			}
+			m, err = compileRegex(path, pattern, options)
+		case "$options":
+			if _, ok := c["$regex"]; !ok {
+				return nil, fmt.Errorf("$options requires $regex")
+			}
+			continue
+		default:
+			return nil, fmt.Errorf("unsupported operator %s", op)
+		}
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return allMatch(matchers), nil
+}
+
+func compileRegex(path, pattern, options string) (docMatcher, error) {
+	var flags string
+	for _, o := range options {
+		switch o {
+		case 'i', 'm', 's':
+			flags += string(o)
+		case 'x':
+		default:
+			return nil, fmt.Errorf("unsupported regex option %c", o)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return fieldMatcher(path, func(v interface{}, found bool) bool {
+		s, ok := v.(string)
+		return ok && re.MatchString(s)
+	}), nil
+}
+
+func compileCompare(path, op string, arg interface{}) docMatcher {
+	if arg == nil {
+		// null is only equal to itself, which matches null and missing fields
+		return fieldMatcher(path, func(v interface{}, found bool) bool {
+			return (op == "$gte" || op == "$lte") && valueEquals(v, found, nil)
+		})
+	}
+	return fieldMatcher(path, func(v interface{}, found bool) bool {
+		c, ok := compareValues(v, arg)
+		if !found || !ok {
+			return false
+		}
+		switch op {
+		case "$gt":
+			return c > 0
+		case "$gte":
+			return c >= 0
+		case "$lt":
+			return c < 0
+		default:
+			return c <= 0
+		}
+	})
+}
+
+// pathValues returns the values at the dotted path in v. Like MongoDB, a path
+// reaching an array continues into each document in it, and a numeric part
+// selects an element, e.g. items.sku and items.0.sku of {items: [{sku: "a"}]}
+func pathValues(v interface{}, path string) []interface{} {
+	parts := strings.SplitN(path, ".", 2)
+	if d, ok := asDoc(v); ok {
+		child, found := d[parts[0]]
+		if !found {
+			return nil
+		} else if len(parts) == 1 {
+			return []interface{}{child}
+		}
+		return pathValues(child, parts[1])
+	}
+	a, ok := asArray(v)
+	if !ok {
+		return nil
+	}
+	var values []interface{}
+	if i, err := strconv.Atoi(parts[0]); err == nil && i >= 0 && i < len(a) {
+		if len(parts) == 1 {
+			values = append(values, a[i])
+		} else {
+			values = append(values, pathValues(a[i], parts[1])...)
+		}
+	}
+	for _, e := range a {
+		if _, ok := asDoc(e); ok {
+			values = append(values, pathValues(e, path)...)
+		}
+	}
+	return values
+}
+
+// fieldMatcher applies test to the values at path and, like MongoDB, to each
+// element of those that are arrays. A missing field is tested once as not found
+func fieldMatcher(path string, test func(v interface{}, found bool) bool) docMatcher {
+	return func(doc map[string]interface{}) bool {
+		values := pathValues(doc, path)
+		if len(values) == 0 {
+			return test(nil, false)
+		}
+		for _, v := range values {
+			if test(v, true) {
+				return true
+			}
+			if a, ok := asArray(v); ok {
+				for _, e := range a {
+					if test(e, true) {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+}
+
+func truthy(v interface{}) bool {
+	switch b := v.(type) {
+	case bool:
+		return b
+	case nil:
+		return false
+	default:
+		if f, err := toFloat(v); err == nil {
+			return f != 0
+		}
+		return true
+	}
+}
+
+func isNumber(v interface{}) bool {
+	switch v.(type) {
+	case int, int32, int64, float32, float64, primitive.Decimal128:
+		return true
+	default:
+		return false
+	}
+}
+
+func asTime(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, true
+	case primitive.DateTime:
+		return time.Unix(0, int64(t)*int64(time.Millisecond)), true
+	default:
+		return time.Time{}, false
+	}
+}
+
+// compareValues orders two numbers, strings or dates
+func compareValues(a, b interface{}) (int, bool) {
+	if isNumber(a) && isNumber(b) {
+		fa, erra := toFloat(a)
+		fb, errb := toFloat(b)
+		if erra != nil || errb != nil {
+			return 0, false
+		}
+		switch {
+		case fa < fb:
+			return -1, true
+		case fa > fb:
+			return 1, true
+		default:
+			return 0, true
+		}
+	}
+	if sa, ok := a.(string); ok {
+		if sb, ok := b.(string); ok {
+			return strings.Compare(sa, sb), true
+		}
+		return 0, false
+	}
+	if ta, ok := asTime(a); ok {
+		if tb, ok := asTime(b); ok {
+			switch {
+			case ta.Before(tb):
+				return -1, true
+			case ta.After(tb):
+				return 1, true
+			default:
+				return 0, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func valueEquals(v interface{}, found bool, want interface{}) bool {
+	if want == nil {
+		return !found || v == nil
+	}
+	if !found {
+		return false
+	}
+	if c, ok := compareValues(v, want); ok {
+		return c == 0
+	}
+	if dv, ok := asDoc(v); ok {
+		dw, ok := asDoc(want)
+		if !ok || len(dv) != len(dw) {
+			return false
+		}
+		for k, w := range dw {
+			e, found := dv[k]
+			if !found || !valueEquals(e, true, w) {
+				return false
+			}
+		}
+		return true
+	}
+	if av, ok := asArray(v); ok {
+		aw, ok := asArray(want)
+		if !ok || len(av) != len(aw) {
+			return false
+		}
+		for i := range av {
+			if !valueEquals(av[i], true, aw[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(v, want)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+	"time"
+)
+
+func compileTestFilter(t *testing.T, filter string) (docMatcher, error) {
+	var query bson.M
+	if err := bson.UnmarshalExtJSON([]byte(filter), false, &query); err != nil {
+		t.Fatalf("%s: %s", filter, err)
+	}
+	return compileQuery(query)
+}
+
+// TestFilterSemantics checks filters against the results MongoDB gives for the same query
+func TestFilterSemantics(t *testing.T) {
+	dec, _ := primitive.ParseDecimal128("2.5")
+	doc := map[string]interface{}{
+		"a":      int64(1),
+		"mixed":  int32(3),
+		"f":      2.5,
+		"dec":    dec,
+		"s":      "Hello",
+		"n":      nil,
+		"tags":   primitive.A{"x", "y"},
+		"arr":    primitive.A{int32(1), int64(5), 10.0},
+		"nested": primitive.A{primitive.A{int32(1), int32(2)}, primitive.A{int32(3)}},
+		"sub":    map[string]interface{}{"v": int32(5)},
+		"items": primitive.A{
+			map[string]interface{}{"sku": "a"},
+			primitive.D{{Key: "sku", Value: "b"}},
+		},
+		"d": time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		// missing fields and null
+		{`{"n": null}`, true},
+		{`{"missing": null}`, true},
+		{`{"a": null}`, false},
+		{`{"n": {"$exists": true}}`, true},
+		{`{"missing": {"$exists": true}}`, false},
+		{`{"missing": {"$exists": false}}`, true},
+		{`{"n": {"$ne": null}}`, false},
+		{`{"missing": {"$ne": null}}`, false},
+		{`{"a": {"$ne": null}}`, true},
+		{`{"n": {"$gte": null}}`, true},
+		{`{"missing": {"$lte": null}}`, true},
+		{`{"n": {"$gt": null}}`, false},
+		{`{"a": {"$gte": null}}`, false},
+		{`{"missing": {"$in": [null, 2]}}`, true},
+		{`{"missing": {"$nin": [1]}}`, true},
+		{`{"missing": {"$ne": 1}}`, true},
+		{`{"missing": {"$gt": 0}}`, false},
+		{`{"missing": {"$lt": 0}}`, false},
+		{`{"missing": {"$not": {"$gt": 1}}}`, true},
+		{`{"a": {"$not": {"$gt": 0}}}`, false},
+		// arrays
+		{`{"tags": "x"}`, true},
+		{`{"tags": ["x", "y"]}`, true},
+		{`{"tags": ["y", "x"]}`, false},
+		{`{"tags": {"$ne": "x"}}`, false},
+		{`{"tags": {"$nin": ["z"]}}`, true},
+		{`{"tags": {"$nin": ["z", "x"]}}`, false},
+		{`{"tags": {"$in": ["z", "y"]}}`, true},
+		{`{"tags": {"$regex": "^y"}}`, true},
+		{`{"tags": {"$exists": true}}`, true},
+		{`{"arr": 5}`, true},
+		{`{"arr": {"$ne": 5}}`, false},
+		{`{"arr": {"$gt": 6, "$lt": 4}}`, true},
+		{`{"arr": {"$gt": 10}}`, false},
+		{`{"arr.2": 10}`, true},
+		{`{"arr.0": 5}`, false},
+		{`{"nested": [1, 2]}`, true},
+		{`{"nested": 1}`, false},
+		{`{"items.sku": "b"}`, true},
+		{`{"items.sku": {"$in": ["c", "a"]}}`, true},
+		{`{"items.0.sku": "a"}`, true},
+		{`{"items.1.sku": "a"}`, false},
+		{`{"items.sku": {"$exists": true}}`, true},
+		{`{"items.qty": {"$exists": true}}`, false},
+		// mixed numeric types
+		{`{"a": 1}`, true},
+		{`{"a": 1.0}`, true},
+		{`{"a": {"$numberLong": "1"}}`, true},
+		{`{"a": {"$numberDecimal": "1.0"}}`, true},
+		{`{"mixed": {"$gt": 2.5}}`, true},
+		{`{"mixed": {"$lte": {"$numberLong": "3"}}}`, true},
+		{`{"f": {"$lt": 3}}`, true},
+		{`{"dec": 2.5}`, true},
+		{`{"dec": {"$gt": 2}}`, true},
+		{`{"a": {"$in": [2, 1.0]}}`, true},
+		{`{"a": "1"}`, false},
+		{`{"a": {"$gt": "0"}}`, false},
+		{`{"s": {"$gt": 0}}`, false},
+		// embedded documents
+		{`{"sub.v": 5}`, true},
+		{`{"sub": {"v": 5}}`, true},
+		{`{"sub": {"v": 5.0}}`, true},
+		{`{"sub": {"v": 5, "w": 1}}`, false},
+		{`{"sub": {"$exists": true}}`, true},
+		// dates
+		{`{"d": {"$gte": {"$date": "2019-01-01T00:00:00Z"}}}`, true},
+		{`{"d": {"$lt": {"$date": "2019-01-01T00:00:00Z"}}}`, false},
+		{`{"d": {"$date": "2019-06-01T00:00:00Z"}}`, true},
+		// regular expressions
+		{`{"s": {"$regex": "^hel", "$options": "i"}}`, true},
+		{`{"s": {"$regex": "^hel"}}`, false},
+		{`{"s": {"$regularExpression": {"pattern": "LL", "options": "i"}}}`, true},
+		{`{"s": {"$not": {"$regex": "^x"}}}`, true},
+		{`{"s": {"$not": {"$regex": "^H"}}}`, false},
+		{`{"missing": {"$regex": "."}}`, false},
+		{`{"missing": {"$not": {"$regex": "."}}}`, true},
+		// logical operators
+		{`{"$and": [{"a": 1}, {"s": "Hello"}]}`, true},
+		{`{"$and": [{"a": 1}, {"s": "hello"}]}`, false},
+		{`{"$or": [{"a": 2}, {"tags": "y"}]}`, true},
+		{`{"$or": [{"a": 2}, {"tags": "z"}]}`, false},
+		{`{"$nor": [{"a": 2}, {"s": "x"}]}`, true},
+		{`{"$nor": [{"a": 1}]}`, false},
+	}
+	for _, test := range tests {
+		match, err := compileTestFilter(t, test.filter)
+		if err != nil {
+			t.Errorf("%s: %s", test.filter, err)
+			continue
+		}
+		if got := match(doc); got != test.want {
+			t.Errorf("%s: expected %v, got %v", test.filter, test.want, got)
+		}
+	}
+}
+
+func TestFilterUnsupported(t *testing.T) {
+	for _, filter := range []string{
+		`{"$where": "this.a > 1"}`,
+		`{"a": {"$size": 1}}`,
+		`{"$or": []}`,
+		`{"$and": [1]}`,
+		`{"a": {"$in": 1}}`,
+		`{"s": {"$options": "i"}}`,
+		`{"s": {"$regex": "a", "$options": "u"}}`,
+		`{"s": {"$not": 1}}`,
+	} {
+		if _, err := compileTestFilter(t, filter); err == nil {
+			t.Errorf("%s: expected an error", filter)
+		}
+	}
+}
@@ -3,7 +3,7 @@ module github.com/rwynn/mongofluxd
 require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/go-stack/stack v1.8.0 // indirect
-	github.com/golang/snappy v0.0.1 // indirect
+	github.com/golang/snappy v0.0.1
 	github.com/google/go-cmp v0.2.0 // indirect
 	github.com/influxdata/influxdb1-client v0.0.0-20190402204710-8ff2fc3824fc
 	github.com/pkg/errors v0.8.1 // indirect
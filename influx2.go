@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/influxdata/influxdb1-client/models"
+	"github.com/influxdata/influxdb1-client/v2"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// influxV2Sink writes batches to the /api/v2/write endpoint of InfluxDB 2.X and 3.X.
+// The database and retention of a measurement are mapped to a bucket named
+// database/retention, or just database when no retention is set
+type influxV2Sink struct {
+	url        url.URL
+	org        string
+	token      string
+	useragent  string
+	httpClient *http.Client
+	orgID      string
+	lock       sync.Mutex
+}
+
+type influxV2Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type influxV2Orgs struct {
+	Orgs []struct {
+		ID string `json:"id"`
+	} `json:"orgs"`
+}
+
+type influxV2Buckets struct {
+	Buckets []struct {
+		ID string `json:"id"`
+	} `json:"buckets"`
+}
+
+func influxV2Bucket(db, rp string) string {
+	if rp == "" {
+		return db
+	}
+	return db + "/" + rp
+}
+
+func influxV2Precision(precision string) string {
+	switch precision {
+	case "n", "ns":
+		return "ns"
+	case "u", "us":
+		return "us"
+	case "ms":
+		return "ms"
+	default:
+		// the v2 API has no minute or hour precision
+		return "s"
+	}
+}
+
+func (s *influxV2Sink) newRequest(method, endpoint string, params url.Values, body io.Reader) (*http.Request, error) {
+	u := s.url
+	u.Path = path.Join(u.Path, endpoint)
+	u.RawQuery = params.Encode()
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", s.useragent)
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+	return req, nil
+}
+
+func (s *influxV2Sink) do(req *http.Request, result interface{}) (int, error) {
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e influxV2Error
+		if json.Unmarshal(body, &e) == nil && e.Message != "" {
+			return resp.StatusCode, fmt.Errorf("InfluxDB returned status %d: %s", resp.StatusCode, e.Message)
+		}
+		return resp.StatusCode, fmt.Errorf("InfluxDB returned status %d: %s", resp.StatusCode, body)
+	}
+	if result != nil && len(body) > 0 {
+		if err = json.Unmarshal(body, result); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+func (s *influxV2Sink) Write(bp client.BatchPoints) error {
+	var b bytes.Buffer
+	precision := influxV2Precision(bp.Precision())
+	for _, p := range bp.Points() {
+		if p == nil {
+			continue
+		}
+		b.WriteString(p.PrecisionString(precision))
+		b.WriteByte('\n')
+	}
+	params := url.Values{}
+	params.Set("org", s.org)
+	params.Set("bucket", influxV2Bucket(bp.Database(), bp.RetentionPolicy()))
+	params.Set("precision", precision)
+	req, err := s.newRequest("POST", "/api/v2/write", params, &b)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	status, err := s.do(req, nil)
+	if err != nil && rejectedStatus(status) {
+		return &rejectedError{err: err}
+	}
+	return err
+}
+
+func (s *influxV2Sink) lookupOrgID() (string, int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.orgID != "" {
+		return s.orgID, http.StatusOK, nil
+	}
+	params := url.Values{}
+	params.Set("org", s.org)
+	req, err := s.newRequest("GET", "/api/v2/orgs", params, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	var orgs influxV2Orgs
+	status, err := s.do(req, &orgs)
+	if err != nil {
+		return "", status, err
+	}
+	if len(orgs.Orgs) == 0 {
+		return "", status, fmt.Errorf("InfluxDB organization %s not found", s.org)
+	}
+	s.orgID = orgs.Orgs[0].ID
+	return s.orgID, status, nil
+}
+
+// CreateDatabase creates the bucket for db and rp if it does not already exist
+func (s *influxV2Sink) CreateDatabase(db, rp string) error {
+	bucket := influxV2Bucket(db, rp)
+	params := url.Values{}
+	params.Set("org", s.org)
+	params.Set("name", bucket)
+	req, err := s.newRequest("GET", "/api/v2/buckets", params, nil)
+	if err != nil {
+		return err
+	}
+	var buckets influxV2Buckets
+	status, err := s.do(req, &buckets)
+	if err != nil && status != http.StatusNotFound {
+		return err
+	}
+	if len(buckets.Buckets) > 0 {
+		return nil
+	}
+	return s.createBucket(bucket)
+}
+
+func (s *influxV2Sink) createBucket(bucket string) error {
+	orgID, status, err := s.lookupOrgID()
+	if status == http.StatusNotFound {
+		// no management API, e.g. InfluxDB 3.X which creates databases on first write
+		return nil
+	} else if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"orgID":          orgID,
+		"name":           bucket,
+		"retentionRules": []interface{}{},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := s.newRequest("POST", "/api/v2/buckets", nil, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	status, err = s.do(req, nil)
+	if status == http.StatusConflict {
+		// created concurrently by another worker
+		return nil
+	}
+	return err
+}
+
+// DeleteSeries removes the series through the v2 delete API using a predicate on the tags
+func (s *influxV2Sink) DeleteSeries(db, rp, measurement string, tags map[string]string) error {
+	var preds []string
+	if measurement != "" {
+		preds = append(preds, "_measurement="+strconv.Quote(measurement))
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		preds = append(preds, k+"="+strconv.Quote(tags[k]))
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		// the whole time range, like DROP SERIES in 1.X, so points with future timestamps go too
+		"start":     time.Unix(0, models.MinNanoTime).UTC().Format(time.RFC3339Nano),
+		"stop":      time.Unix(0, models.MaxNanoTime).UTC().Format(time.RFC3339Nano),
+		"predicate": strings.Join(preds, " AND "),
+	})
+	if err != nil {
+		return err
+	}
+	params := url.Values{}
+	params.Set("org", s.org)
+	params.Set("bucket", influxV2Bucket(db, rp))
+	req, err := s.newRequest("POST", "/api/v2/delete", params, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	status, err := s.do(req, nil)
+	if err != nil && rejectedStatus(status) {
+		return &rejectedError{err: err}
+	}
+	return err
+}
+
+func (s *influxV2Sink) Ping(timeout time.Duration) error {
+	req, err := s.newRequest("GET", "/ping", nil, nil)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, err = s.do(req.WithContext(ctx), nil)
+	return err
+}
+
+func (s *influxV2Sink) Close() error {
+	return nil
+}
+
+func (config *configOptions) newInfluxV2Sink() (Sink, error) {
+	u, err := url.Parse(config.InfluxURL)
+	if err != nil {
+		return nil, err
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("Unsupported protocol scheme: %s, your address must start with http:// or https://", u.Scheme)
+	}
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: config.InfluxSkipVerify,
+		},
+	}
+	if config.InfluxPemFile != "" {
+		tlsConfig, err := config.InfluxTLS()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to configure TLS for InfluxDB: %s", err)
+		}
+		tr.TLSClientConfig = tlsConfig
+	}
+	return &influxV2Sink{
+		url:        *u,
+		org:        config.InfluxOrg,
+		token:      config.InfluxToken,
+		useragent:  fmt.Sprintf("%s v%s", Name, Version),
+		httpClient: &http.Client{Transport: tr},
+	}, nil
+}
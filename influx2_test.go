@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInfluxV2DeleteSeriesRange(t *testing.T) {
+	var body map[string]string
+	var query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		json.NewDecoder(r.Body).Decode(&body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	config := newConfig()
+	config.InfluxURL = srv.URL
+	config.InfluxOrg = "org"
+	sink, err := config.newInfluxV2Sink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.(Deleter).DeleteSeries("db", "", "col", map[string]string{"id": "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := `_measurement="col" AND id="a"`; body["predicate"] != want {
+		t.Fatalf("expected predicate %q, got %q", want, body["predicate"])
+	}
+	if query != "bucket=db&org=org" {
+		t.Fatalf("expected the bucket db of org, got %s", query)
+	}
+	start, err := time.Parse(time.RFC3339Nano, body["start"])
+	if err != nil || start.Year() > 1700 {
+		t.Fatalf("expected the delete to start at the earliest time, got %s", body["start"])
+	}
+	stop, err := time.Parse(time.RFC3339Nano, body["stop"])
+	if err != nil || stop.Year() < 2262 {
+		t.Fatalf("expected the delete to stop at the latest time, got %s", body["stop"])
+	}
+}
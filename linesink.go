@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"github.com/influxdata/influxdb1-client/v2"
+	"io"
+	"os"
+	"sync"
+)
+
+// lineProtocolSink writes batches as InfluxDB line protocol to a file or stdout.
+// Timestamps are always written in nanoseconds, whatever the precision of each
+// measurement, so that the output can be loaded with a single precision.
+// It is shared by all workers so writes are serialized
+type lineProtocolSink struct {
+	lock   sync.Mutex
+	w      *bufio.Writer
+	closer io.Closer
+}
+
+func (s *lineProtocolSink) Write(bp client.BatchPoints) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, p := range bp.Points() {
+		if p == nil {
+			continue
+		}
+		if _, err := s.w.WriteString(p.String()); err != nil {
+			return err
+		}
+		if err := s.w.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+	return s.w.Flush()
+}
+
+func (s *lineProtocolSink) CreateDatabase(db, rp string) error {
+	return nil
+}
+
+func (s *lineProtocolSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err := s.w.Flush()
+	if s.closer != nil {
+		if cerr := s.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func newLineProtocolSink(path string) (Sink, error) {
+	if path == "" {
+		// keep log messages out of the exported data
+		infoLog.SetOutput(os.Stderr)
+		errorLog.SetOutput(os.Stderr)
+		return &lineProtocolSink{w: bufio.NewWriter(os.Stdout)}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &lineProtocolSink{w: bufio.NewWriter(f), closer: f}, nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/mongo"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const healthCheckTimeout = 5 * time.Second
+
+var (
+	batchSizeBuckets    = []float64{1, 10, 100, 500, 1000, 5000, 10000}
+	flushSecondsBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+)
+
+// stats collects the runtime metrics served on /metrics
+var stats = newMetrics()
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+type metrics struct {
+	lock          sync.Mutex
+	ops           map[[2]string]uint64
+	pointsWritten uint64
+	pointsDropped uint64
+	writeErrors   uint64
+	mappingErrors map[string]uint64
+	batchSize     *histogram
+	flushSeconds  *histogram
+	ckpt          *checkpoint
+	writeFailing  bool
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		ops:           make(map[[2]string]uint64),
+		mappingErrors: make(map[string]uint64),
+		batchSize:     newHistogram(batchSizeBuckets),
+		flushSeconds:  newHistogram(flushSecondsBuckets),
+	}
+}
+
+func operationName(op string) string {
+	switch op {
+	case "i":
+		return "insert"
+	case "u":
+		return "update"
+	case "d":
+		return "delete"
+	case "c":
+		return "command"
+	default:
+		return op
+	}
+}
+
+func (s *metrics) opReceived(ns, op string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ops[[2]string{ns, operationName(op)}]++
+}
+
+// follow measures the replication lag from the ops ckpt is waiting for
+func (s *metrics) follow(ckpt *checkpoint) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ckpt = ckpt
+}
+
+// lag returns the seconds since the cluster time of the oldest op not yet
+// flushed, or 0 when every op received has been flushed
+func (s *metrics) lag() float64 {
+	if ts, ok := s.ckpt.oldest(); ok {
+		return time.Since(TimestampTime(ts)).Seconds()
+	}
+	return 0
+}
+
+// batchWritten records the outcome of writing a batch of points
+func (s *metrics) batchWritten(points int, elapsed time.Duration, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.batchSize.observe(float64(points))
+	s.flushSeconds.observe(elapsed.Seconds())
+	if err == nil {
+		s.pointsWritten += uint64(points)
+		s.writeFailing = false
+		return
+	}
+	s.writeErrors++
+	if isRejected(err) {
+		s.pointsDropped += uint64(points)
+	} else {
+		s.writeFailing = true
+	}
+}
+
+func (s *metrics) mappingFailed(reason string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.mappingErrors[reason]++
+}
+
+func (s *metrics) failing() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.writeFailing
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(v)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func writeHelp(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeHistogram(w io.Writer, name, help string, h *histogram) {
+	writeHelp(w, name, "histogram", help)
+	for i, le := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(le), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// writeTo writes the metrics in the Prometheus text exposition format
+func (s *metrics) writeTo(w io.Writer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	writeHelp(w, "mongofluxd_ops_received_total", "counter", "Change events and documents received from MongoDB")
+	keys := make([][2]string, 0, len(s.ops))
+	for k := range s.ops {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "mongofluxd_ops_received_total{namespace=\"%s\",operation=\"%s\"} %d\n",
+			escapeLabel(k[0]), escapeLabel(k[1]), s.ops[k])
+	}
+	writeHelp(w, "mongofluxd_points_written_total", "counter", "Points written to the output")
+	fmt.Fprintf(w, "mongofluxd_points_written_total %d\n", s.pointsWritten)
+	writeHelp(w, "mongofluxd_points_dropped_total", "counter", "Points in batches rejected by the output")
+	fmt.Fprintf(w, "mongofluxd_points_dropped_total %d\n", s.pointsDropped)
+	writeHelp(w, "mongofluxd_write_errors_total", "counter", "Batches that could not be written after retrying")
+	fmt.Fprintf(w, "mongofluxd_write_errors_total %d\n", s.writeErrors)
+	writeHelp(w, "mongofluxd_mapping_errors_total", "counter", "Documents that could not be mapped to points")
+	reasons := make([]string, 0, len(s.mappingErrors))
+	for r := range s.mappingErrors {
+		reasons = append(reasons, r)
+	}
+	sort.Strings(reasons)
+	for _, r := range reasons {
+		fmt.Fprintf(w, "mongofluxd_mapping_errors_total{reason=\"%s\"} %d\n", escapeLabel(r), s.mappingErrors[r])
+	}
+	writeHistogram(w, "mongofluxd_batch_size", "Points per batch written", s.batchSize)
+	writeHistogram(w, "mongofluxd_flush_duration_seconds", "Time taken to write a batch including retries", s.flushSeconds)
+	writeHelp(w, "mongofluxd_replication_lag_seconds", "gauge", "Seconds since the cluster time of the oldest change event not yet written")
+	if s.ckpt != nil {
+		fmt.Fprintf(w, "mongofluxd_replication_lag_seconds %s\n", formatFloat(s.lag()))
+	}
+}
+
+// healthChecks reports the connectivity of MongoDB and the output
+type healthChecks struct {
+	client *mongo.Client
+	sink   Sink
+	ready  func() bool
+}
+
+func (h *healthChecks) check() map[string]error {
+	results := make(map[string]error)
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	results["mongodb"] = h.client.Ping(ctx, nil)
+	if p, ok := h.sink.(Pinger); ok {
+		results["output"] = p.Ping(healthCheckTimeout)
+	}
+	return results
+}
+
+func (h *healthChecks) respond(w http.ResponseWriter, results map[string]error) {
+	var b bytes.Buffer
+	status := http.StatusOK
+	names := make([]string, 0, len(results))
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := results[name]; err != nil {
+			status = http.StatusServiceUnavailable
+			fmt.Fprintf(&b, "%s: %s\n", name, err)
+		} else {
+			fmt.Fprintf(&b, "%s: ok\n", name)
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(b.Bytes())
+}
+
+// serveMetrics serves /metrics, /healthz and /readyz. /healthz checks that
+// MongoDB and the output can be reached. /readyz also requires that syncing
+// has started and that batches are being written
+func serveMetrics(addr string, h *healthChecks) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		stats.writeTo(w)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		h.respond(w, h.check())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		results := h.check()
+		if !h.ready() {
+			results["sync"] = fmt.Errorf("not started")
+		} else if stats.failing() {
+			results["sync"] = fmt.Errorf("writes to the output are failing")
+		} else {
+			results["sync"] = nil
+		}
+		h.respond(w, results)
+	})
+	return http.ListenAndServe(addr, mux)
+}
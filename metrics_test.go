@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scrapeLag(t *testing.T, s *metrics) float64 {
+	var b bytes.Buffer
+	s.writeTo(&b)
+	for _, line := range strings.Split(b.String(), "\n") {
+		if strings.HasPrefix(line, "mongofluxd_replication_lag_seconds ") {
+			lag, err := strconv.ParseFloat(strings.TrimPrefix(line, "mongofluxd_replication_lag_seconds "), 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return lag
+		}
+	}
+	t.Fatalf("no replication lag in %s", b.String())
+	return 0
+}
+
+func TestReplicationLagFollowsFlushes(t *testing.T) {
+	s := newMetrics()
+	cp := newCheckpoint(nil)
+	s.follow(cp)
+	if lag := scrapeLag(t, s); lag != 0 {
+		t.Fatalf("expected no lag before any op, got %v", lag)
+	}
+	old := oplogOp(uint32(time.Now().Add(-time.Minute).Unix()))
+	cp.enter(old)
+	if lag := scrapeLag(t, s); lag < 59 {
+		t.Fatalf("expected the lag of an op in flight, got %v", lag)
+	}
+	// a stalled worker keeps the op buffered
+	cp.track(1, old)
+	if lag := scrapeLag(t, s); lag < 59 {
+		t.Fatalf("expected the lag of a buffered op, got %v", lag)
+	}
+	if err := cp.flush(1, old.Timestamp, nil); err != nil {
+		t.Fatal(err)
+	}
+	if lag := scrapeLag(t, s); lag != 0 {
+		t.Fatalf("expected no lag once flushed, got %v", lag)
+	}
+	if cp.flushed != old.Timestamp {
+		t.Fatalf("expected the flushed position to move to %+v, got %+v", old.Timestamp, cp.flushed)
+	}
+}
@@ -23,14 +23,19 @@ import (
 	"os/signal"
 	"plugin"
 	"reflect"
+	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"text/template"
 	"time"
 )
 
 var exitStatus = 0
+
+// docRef matches the parts of a measure template that depend on the content of a document
+var docRef = regexp.MustCompile(`\.(Doc|Fields)\b`)
 var infoLog *log.Logger = log.New(os.Stdout, "INFO ", log.Flags())
 var errorLog *log.Logger = log.New(os.Stdout, "ERROR ", log.Flags())
 
@@ -43,6 +48,12 @@ const (
 	influxBufferDefault   = 1000
 	resumeNameDefault     = "default"
 	gtmChannelSizeDefault = 512
+	deletesTombstone      = "tombstone"
+	deletesSeries         = "delete"
+	deletesPlugin         = "plugin"
+	idTagDefault          = "_id"
+	updatesFull           = "full"
+	updatesChanged        = "changed"
 )
 
 type gtmSettings struct {
@@ -51,26 +62,47 @@ type gtmSettings struct {
 	BufferDuration string `toml:"buffer-duration"`
 }
 
+type retrySettings struct {
+	MaxAttempts int     `toml:"max-attempts"`
+	Backoff     string  `toml:"backoff"`
+	MaxBackoff  string  `toml:"max-backoff"`
+	Jitter      float64 `toml:"jitter"`
+}
+
 type measureSettings struct {
-	Namespace string
-	View      string
-	Timefield string
-	Retention string
-	Precision string
-	Measure   string
-	Database  string
-	Symbol    string
-	Tags      []string
-	Fields    []string
-	plug      func(*mongofluxdplug.MongoDocument) ([]*mongofluxdplug.InfluxPoint, error)
+	Namespace       string
+	NamespaceRegex  string `toml:"namespace-regex"`
+	View            string
+	Timefield       string
+	TimefieldFormat string `toml:"timefield-format"`
+	Retention       string
+	Precision       string
+	Measure         string
+	Database        string
+	Symbol          string
+	Tags            []string
+	Fields          []string
+	Arrays          []string
+	UDPAddr         string `toml:"udp-addr"`
+	Deletes         string
+	Updates         string
+	Filter          string
+	plug            func(*mongofluxdplug.MongoDocument) ([]*mongofluxdplug.InfluxPoint, error)
+	sink            Sink
+	nsPattern       *regexp.Regexp
+	query           bson.M
+	match           docMatcher
 }
 
 type configOptions struct {
-	MongoURL                 string      `toml:"mongo-url"`
-	MongoOpLogDatabaseName   string      `toml:"mongo-oplog-database-name"`
-	MongoOpLogCollectionName string      `toml:"mongo-oplog-collection-name"`
-	GtmSettings              gtmSettings `toml:"gtm-settings"`
-	ResumeName               string      `toml:"resume-name"`
+	MongoURL                 string        `toml:"mongo-url"`
+	MongoURLFile             string        `toml:"mongo-url-file"`
+	MongoOpLogDatabaseName   string        `toml:"mongo-oplog-database-name"`
+	MongoOpLogCollectionName string        `toml:"mongo-oplog-collection-name"`
+	GtmSettings              gtmSettings   `toml:"gtm-settings"`
+	RetrySettings            retrySettings `toml:"retry-settings"`
+	ResumeName               string        `toml:"resume-name"`
+	ResumeStore              string        `toml:"resume-store"`
 	Version                  bool
 	Verbose                  bool
 	Resume                   bool
@@ -82,6 +114,12 @@ type configOptions struct {
 	InfluxURL                string `toml:"influx-url"`
 	InfluxUser               string `toml:"influx-user"`
 	InfluxPassword           string `toml:"influx-password"`
+	InfluxPasswordFile       string `toml:"influx-password-file"`
+	InfluxOrg                string `toml:"influx-org"`
+	InfluxToken              string `toml:"influx-token"`
+	InfluxTokenFile          string `toml:"influx-token-file"`
+	InfluxUDPAddr            string `toml:"influx-udp-addr"`
+	InfluxUDPPayloadSize     int    `toml:"influx-udp-payload-size"`
 	InfluxSkipVerify         bool   `toml:"influx-skip-verify"`
 	InfluxPemFile            string `toml:"influx-pem-file"`
 	InfluxAutoCreateDB       bool   `toml:"influx-auto-create-db"`
@@ -91,6 +129,20 @@ type configOptions struct {
 	ChangeStreams            bool   `toml:"change-streams"`
 	ExitAfterDirectReads     bool   `toml:"exit-after-direct-reads"`
 	PluginPath               string `toml:"plugin-path"`
+	Output                   string
+	SpoolDir                 string `toml:"spool-dir"`
+	SpoolMaxSize             int64  `toml:"spool-max-size"`
+	SpoolFullPolicy          string `toml:"spool-full-policy"`
+	DeadLetter               string `toml:"dead-letter"`
+	MetricsAddr              string `toml:"metrics-addr"`
+	DryRun                   bool   `toml:"dry-run"`
+	validate                 bool
+	// the names of the flags given on the command line
+	given map[string]bool
+	// the measurement given with flags, if any
+	cliMeasurement *measureSettings
+	// the change streams started, in order
+	streams []string
 }
 
 type dbcol struct {
@@ -99,27 +151,57 @@ type dbcol struct {
 }
 
 type InfluxMeasure struct {
-	ns         string
-	view       *dbcol
-	timefield  string
-	retention  string
-	precision  string
-	measure    string
-	measureTpl *template.Template
-	database   string
-	tags       map[string]string
-	fields     map[string]string
-	plug       func(*mongofluxdplug.MongoDocument) ([]*mongofluxdplug.InfluxPoint, error)
+	ns              string
+	pattern         *regexp.Regexp
+	match           []string
+	view            *dbcol
+	timefield       string
+	timefieldFormat string
+	retention       string
+	precision       string
+	measure         string
+	measureTpl      *template.Template
+	database        string
+	tags            map[string]string
+	tagFormats      map[string]string
+	fields          map[string]string
+	fieldTypes      map[string]string
+	arrays          map[string]*arrayStrategy
+	deletes         string
+	updates         string
+	filter          docMatcher
+	plug            func(*mongofluxdplug.MongoDocument) ([]*mongofluxdplug.InfluxPoint, error)
+	sink            Sink
 }
 
 type InfluxCtx struct {
-	m        map[string]client.BatchPoints
-	c        client.Client
+	id       int
+	m        map[*InfluxMeasure]client.BatchPoints
+	sink     Sink
 	dbs      map[string]bool
-	measures map[string]*InfluxMeasure
+	measures map[string][]*InfluxMeasure
+	patterns []*InfluxMeasure
+	resolved map[string][]*InfluxMeasure
 	config   *configOptions
+	retry    *retrier
 	lastTs   primitive.Timestamp
+	tokens   map[string]*resumeToken
+	ckpt     *checkpoint
 	client   *mongo.Client
+	dead     DeadLetter
+	// series deletes not yet applied, in the order of the ops
+	deletes []*seriesDelete
+}
+
+// seriesDelete drops the series of a deleted document once the points buffered
+// before the delete are written
+type seriesDelete struct {
+	deleter     Deleter
+	before      map[*InfluxMeasure]client.BatchPoints
+	database    string
+	retention   string
+	measurement string
+	tags        map[string]string
 }
 
 type InfluxDataMap struct {
@@ -131,6 +213,10 @@ type InfluxDataMap struct {
 	t         time.Time
 	name      string
 	nameTpl   *template.Template
+	changed   []string
+	// the exploded array of the document, if any
+	elements     []interface{}
+	elementsPath string
 }
 
 func TimestampTime(ts primitive.Timestamp) time.Time {
@@ -149,11 +235,29 @@ func (im *InfluxMeasure) parseView(view string) error {
 	return nil
 }
 
-func (ctx *InfluxCtx) saveTs() (err error) {
-	if ctx.config.Resume && ctx.lastTs.T > 0 {
-		err = saveTimestamp(ctx.client, ctx.lastTs, ctx.config)
-		ctx.lastTs = primitive.Timestamp{}
+// trackTs records the position of an op buffered by the worker. Positions are
+// tracked without resume too since the replication lag is measured from them
+func (ctx *InfluxCtx) trackTs(op *gtm.Op, token *resumeToken) {
+	if op.IsSourceOplog() && tsBefore(ctx.lastTs, op.Timestamp) {
+		ctx.lastTs = op.Timestamp
 	}
+	if token != nil {
+		if rt := ctx.tokens[token.ns]; rt == nil || !tsBefore(token.ts, rt.ts) {
+			ctx.tokens[token.ns] = token
+		}
+	}
+	ctx.ckpt.track(ctx.id, op)
+}
+
+// skipTs lets the checkpoint move past an op that has no points
+func (ctx *InfluxCtx) skipTs(op *gtm.Op) {
+	ctx.ckpt.release(op)
+}
+
+func (ctx *InfluxCtx) saveTs() (err error) {
+	err = ctx.ckpt.flush(ctx.id, ctx.lastTs, ctx.tokens)
+	ctx.lastTs = primitive.Timestamp{}
+	ctx.tokens = make(map[string]*resumeToken)
 	return
 }
 
@@ -162,15 +266,24 @@ func (ctx *InfluxCtx) setupMeasurements() error {
 	if len(mss) > 0 {
 		for _, ms := range mss {
 			im := &InfluxMeasure{
-				ns:        ms.Namespace,
-				timefield: ms.Timefield,
-				retention: ms.Retention,
-				precision: ms.Precision,
-				measure:   ms.Measure,
-				database:  ms.Database,
-				plug:      ms.plug,
-				tags:      make(map[string]string),
-				fields:    make(map[string]string),
+				ns:              ms.Namespace,
+				timefield:       ms.Timefield,
+				timefieldFormat: ms.TimefieldFormat,
+				retention:       ms.Retention,
+				precision:       ms.Precision,
+				measure:         ms.Measure,
+				database:        ms.Database,
+				deletes:         ms.Deletes,
+				updates:         ms.Updates,
+				plug:            ms.plug,
+				sink:            ms.sink,
+				pattern:         ms.nsPattern,
+				filter:          ms.match,
+				tags:            make(map[string]string),
+				tagFormats:      make(map[string]string),
+				fields:          make(map[string]string),
+				fieldTypes:      make(map[string]string),
+				arrays:          make(map[string]*arrayStrategy),
 			}
 			if ms.View != "" {
 				im.ns = ms.View
@@ -178,11 +291,16 @@ func (ctx *InfluxCtx) setupMeasurements() error {
 					return err
 				}
 			}
-			if im.database == "" {
+			if im.pattern != nil {
+				// the database and measure default to those of each matching namespace
+				im.ns = ms.pattern()
+			} else if im.database == "" {
 				im.database = strings.SplitN(im.ns, ".", 2)[0]
 			}
 			if im.measure == "" {
-				im.measure = strings.SplitN(im.ns, ".", 2)[1]
+				if im.pattern == nil {
+					im.measure = strings.SplitN(im.ns, ".", 2)[1]
+				}
 			} else {
 				if strings.Contains(im.measure, "{{") {
 					// detect and create go text/template for measure name
@@ -197,29 +315,85 @@ func (ctx *InfluxCtx) setupMeasurements() error {
 				im.precision = "s"
 			}
 			for _, tag := range ms.Tags {
-				names := strings.SplitN(tag, ":", 2)
-				if len(names) < 2 {
+				names := strings.SplitN(tag, ":", 3)
+				if len(names) < 2 || names[1] == "" {
 					im.tags[names[0]] = names[0]
 				} else {
 					im.tags[names[0]] = names[1]
 				}
+				if len(names) == 3 {
+					im.tagFormats[names[0]] = names[2]
+				}
 			}
 			for _, field := range ms.Fields {
-				names := strings.SplitN(field, ":", 2)
-				if len(names) < 2 {
+				names := strings.SplitN(field, ":", 3)
+				if len(names) < 2 || names[1] == "" {
 					im.fields[names[0]] = names[0]
 				} else {
 					im.fields[names[0]] = names[1]
 				}
+				if len(names) == 3 {
+					if !validFieldType(names[2]) {
+						return fmt.Errorf("Unsupported type %s for field %s in %s", names[2], names[0], ms.pattern())
+					}
+					im.fieldTypes[names[0]] = names[2]
+				}
+			}
+			exploded := ""
+			for _, spec := range ms.Arrays {
+				path, as, err := parseArrayStrategy(spec)
+				if err != nil {
+					return fmt.Errorf("%s in %s", err, ms.pattern())
+				}
+				if as.strategy == arrayExplode {
+					if exploded != "" {
+						return fmt.Errorf("only one array can be exploded but %s and %s are in %s", exploded, path, ms.pattern())
+					}
+					exploded = path
+				}
+				im.arrays[path] = as
 			}
 			if im.plug == nil {
 				if len(im.fields) == 0 {
 					return fmt.Errorf("at least one field is required per measurement")
 				}
 			}
-			ctx.measures[ms.Namespace] = im
+			switch im.deletes {
+			case "":
+			case deletesTombstone:
+				if im.measureTpl != nil && docRef.MatchString(im.measure) {
+					return fmt.Errorf("deletes = %q cannot be used with a measure named from .Doc or .Fields for %s", im.deletes, ms.pattern())
+				}
+			case deletesSeries:
+				if _, ok := im.tags["_id"]; !ok {
+					return fmt.Errorf("deletes = %q requires _id to be mapped to a tag for %s", im.deletes, ms.pattern())
+				}
+				sink := ms.sink
+				if sink == nil {
+					sink = ctx.sink
+				}
+				if _, ok := deleterOf(sink); !ok {
+					return fmt.Errorf("deletes = %q is not supported by the output for %s", im.deletes, ms.pattern())
+				}
+			case deletesPlugin:
+				if im.plug == nil {
+					return fmt.Errorf("deletes = %q requires a plugin symbol for %s", im.deletes, ms.pattern())
+				}
+			default:
+				return fmt.Errorf("Unsupported deletes %q for %s", im.deletes, ms.pattern())
+			}
+			switch im.updates {
+			case "", updatesFull, updatesChanged:
+			default:
+				return fmt.Errorf("Unsupported updates %q for %s", im.updates, ms.pattern())
+			}
+			if im.pattern != nil {
+				ctx.patterns = append(ctx.patterns, im)
+				continue
+			}
+			ctx.measures[ms.Namespace] = append(ctx.measures[ms.Namespace], im)
 			if ms.View != "" {
-				ctx.measures[ms.View] = im
+				ctx.measures[ms.View] = append(ctx.measures[ms.View], im)
 			}
 		}
 		return nil
@@ -228,28 +402,28 @@ func (ctx *InfluxCtx) setupMeasurements() error {
 	}
 }
 
-func (ctx *InfluxCtx) createDatabase(db string) error {
+func (ctx *InfluxCtx) sinkFor(measure *InfluxMeasure) Sink {
+	if measure.sink != nil {
+		return measure.sink
+	}
+	return ctx.sink
+}
+
+func (ctx *InfluxCtx) createDatabase(db, rp string) error {
 	if ctx.config.InfluxAutoCreateDB {
-		if ctx.dbs[db] == false {
-			q := client.NewQuery(fmt.Sprintf(`CREATE DATABASE "%s"`, db), "", "")
-			if response, err := ctx.c.Query(q); err != nil || response.Error() != nil {
-				if err != nil {
-					return err
-				} else {
-					return response.Error()
-				}
-			} else {
-				ctx.dbs[db] = true
+		key := db + "/" + rp
+		if ctx.dbs[key] == false {
+			if err := ctx.sink.CreateDatabase(db, rp); err != nil {
+				return err
 			}
+			ctx.dbs[key] = true
 		}
 	}
 	return nil
 }
 
-func (ctx *InfluxCtx) setupDatabase(op *gtm.Op) error {
-	ns := op.Namespace
-	if _, found := ctx.m[ns]; found == false {
-		measure := ctx.measures[ns]
+func (ctx *InfluxCtx) setupDatabase(measure *InfluxMeasure) error {
+	if _, found := ctx.m[measure]; found == false {
 		bp, err := client.NewBatchPoints(client.BatchPointsConfig{
 			Database:        measure.database,
 			RetentionPolicy: measure.retention,
@@ -258,41 +432,92 @@ func (ctx *InfluxCtx) setupDatabase(op *gtm.Op) error {
 		if err != nil {
 			return err
 		}
-		ctx.m[ns] = bp
-		if err := ctx.createDatabase(measure.database); err != nil {
-			return err
+		ctx.m[measure] = bp
+		if measure.sink == nil {
+			// measurement sinks are UDP listeners with a fixed database
+			if err := ctx.createDatabase(measure.database, measure.retention); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
+// writeBatch writes the points buffered before each pending series delete, applies
+// the delete, and then writes the points buffered since
 func (ctx *InfluxCtx) writeBatch() (err error) {
+	for len(ctx.deletes) > 0 {
+		d := ctx.deletes[0]
+		if werr := ctx.writeBatches(d.before); len(d.before) > 0 {
+			// keep the delete and everything buffered after it for the next flush
+			return werr
+		} else if err == nil {
+			err = werr
+		}
+		if derr := ctx.retry.do(func() error {
+			return d.deleter.DeleteSeries(d.database, d.retention, d.measurement, d.tags)
+		}); derr != nil {
+			if !isRejected(derr) {
+				return fmt.Errorf("Unable to delete series tagged %v: %s", d.tags, derr)
+			}
+			// retrying will not help so the delete is dropped
+			if err == nil {
+				err = fmt.Errorf("Dropped delete of series tagged %v: %s", d.tags, derr)
+			}
+		}
+		ctx.deletes = ctx.deletes[1:]
+	}
+	if werr := ctx.writeBatches(ctx.m); err == nil {
+		err = werr
+	}
+	if len(ctx.m) == 0 {
+		// only advance the resume timestamp once every batch has landed
+		if serr := ctx.saveTs(); err == nil {
+			err = serr
+		}
+	}
+	return
+}
+
+// writeBatches writes the batches in m, removing each one written or rejected
+func (ctx *InfluxCtx) writeBatches(m map[*InfluxMeasure]client.BatchPoints) (err error) {
 	points := 0
-	for _, bp := range ctx.m {
-		points += len(bp.Points())
-		if err = ctx.c.Write(bp); err != nil {
+	for measure, bp := range m {
+		sink := ctx.sinkFor(measure)
+		start := time.Now()
+		werr := ctx.retry.do(func() error { return sink.Write(bp) })
+		if len(bp.Points()) > 0 {
+			stats.batchWritten(len(bp.Points()), time.Since(start), werr)
+		}
+		if werr != nil {
+			if isRejected(werr) {
+				// retrying will not help so the batch is dropped
+				delete(m, measure)
+				err = fmt.Errorf("Dropped %d points for %s: %s", len(bp.Points()), measure.ns, werr)
+				continue
+			}
+			// keep this and any remaining batches to write on the next flush
+			err = werr
 			break
 		}
+		points += len(bp.Points())
+		delete(m, measure)
 	}
 	if ctx.config.Verbose {
 		if points > 0 {
 			infoLog.Printf("%d points flushed\n", points)
 		}
 	}
-	ctx.m = make(map[string]client.BatchPoints)
-	if err == nil {
-		err = ctx.saveTs()
-	}
 	return
 }
 
-func (m *InfluxDataMap) istagtype(v interface{}) bool {
-	switch v.(type) {
-	case string:
-		return true
-	default:
-		return false
+// idTag formats the _id of a document as the value of the tag it is mapped to
+func (im *InfluxMeasure) idTag(id interface{}) (string, error) {
+	v, err := formatTag(id, im.tagFormats["_id"])
+	if err != nil {
+		return "", fmt.Errorf("unable to format _id as a tag: %s", err)
 	}
+	return v, nil
 }
 
 func (m *InfluxDataMap) isfieldtype(v interface{}) bool {
@@ -326,9 +551,7 @@ func (m *InfluxDataMap) flatmap(prefix string, e map[string]interface{}) map[str
 				o[prefix+k+"."+nk] = nv
 			}
 		default:
-			if m.isfieldtype(v) {
-				o[prefix+k] = v
-			}
+			o[prefix+k] = v
 		}
 	}
 	return o
@@ -338,29 +561,42 @@ func (m *InfluxDataMap) unsupportedType(op *gtm.Op, k string, v interface{}, kin
 	errorLog.Printf("Unsupported type %T for %s %s in namespace %s\n", v, kind, k, op.Namespace)
 }
 
-func (m *InfluxDataMap) loadKV(k string, v interface{}) {
+func (m *InfluxDataMap) loadKV(k string, v interface{}) error {
 	if name, ok := m.measure.tags[k]; ok {
-		if m.istagtype(v) {
-			m.tags[name] = v.(string)
+		if tv, err := formatTag(v, m.measure.tagFormats[k]); err == nil {
+			m.tags[name] = tv
 		} else {
-			m.unsupportedType(m.op, k, v, "tag")
+			errorLog.Printf("Unable to map tag %s in namespace %s: %s\n", k, m.op.Namespace, err)
 		}
-	} else if name, ok := m.measure.fields[k]; ok {
-		if m.isfieldtype(v) {
+	} else if name, typ, ok := m.measure.fieldFor(k); ok {
+		if m.changed != nil && !touched(m.changed, k) {
+			return nil
+		}
+		if typ != "" {
+			cv, err := coerceField(v, typ)
+			if err != nil {
+				return fmt.Errorf("field %s: %s", k, err)
+			}
+			m.fields[name] = cv
+		} else if m.isfieldtype(v) {
 			m.fields[name] = v
 		} else {
 			m.unsupportedType(m.op, k, v, "field")
 		}
 	}
+	return nil
 }
 
 func (m *InfluxDataMap) resolveName(tags map[string]string, fields, doc map[string]interface{}) error {
 	if m.nameTpl != nil {
 		var b bytes.Buffer
 		env := map[string]interface{}{
-			"Tags":   tags,
-			"Fields": fields,
-			"Doc":    doc,
+			"Tags":       tags,
+			"Fields":     fields,
+			"Doc":        doc,
+			"Database":   m.op.GetDatabase(),
+			"Collection": m.op.GetCollection(),
+			"Match":      m.measure.match,
 		}
 		if err := m.nameTpl.Execute(&b, env); err != nil {
 			return err
@@ -376,43 +612,129 @@ func (m *InfluxDataMap) loadData() error {
 	if m.measure.timefield == "" {
 		m.t = TimestampTime(m.op.Timestamp)
 		m.timefield = true
+	} else if tf, ok := lookupPath(m.op.Data, m.measure.timefield); ok {
+		t, err := parseTime(tf, m.measure.timefieldFormat)
+		if err != nil {
+			return fmt.Errorf("time field %s: %s", m.measure.timefield, err)
+		}
+		m.t = t
+		m.timefield = true
 	}
 	for k, v := range m.op.Data {
 		if k == "_id" {
-			continue
+			if _, ok := m.measure.tags[k]; !ok {
+				continue
+			}
 		}
 		switch vt := v.(type) {
-		case time.Time:
-			if m.measure.timefield == k {
-				m.t = vt.UTC()
-				m.timefield = true
-			}
-		case primitive.Timestamp:
-			if m.measure.timefield == k {
-				m.t = TimestampTime(vt)
-				m.timefield = true
-			}
 		case map[string]interface{}:
 			flat := m.flatmap(k+".", vt)
 			for fk, fv := range flat {
-				m.loadKV(fk, fv)
+				if err := m.loadValue(fk, fv); err != nil {
+					return err
+				}
 			}
-		default:
-			m.loadKV(k, v)
+			continue
+		}
+		if err := m.loadValue(k, v); err != nil {
+			return err
 		}
 	}
 	if m.timefield == false {
-		if tf, ok := m.op.Data[m.measure.timefield]; ok {
-			return fmt.Errorf("time field %s had type %T, but expected %T", m.measure.timefield, tf, m.t)
-		} else {
-			return fmt.Errorf("time field %s not found in document", m.measure.timefield)
-		}
+		return fmt.Errorf("time field %s not found in document", m.measure.timefield)
 	} else {
 		return nil
 	}
 
 }
 
+// tombstone maps a deleted document to a point flagging its _id as deleted
+func (m *InfluxDataMap) tombstone() error {
+	name, ok := m.measure.tags["_id"]
+	if !ok {
+		name = idTagDefault
+	}
+	id, err := m.measure.idTag(m.op.Id)
+	if err != nil {
+		return err
+	}
+	m.tags = map[string]string{name: id}
+	m.fields = map[string]interface{}{"deleted": true}
+	m.t = TimestampTime(m.op.Timestamp)
+	return nil
+}
+
+// updateDescription returns the fields set and unset by an update when the
+// change stream reported them
+func updateDescription(op *gtm.Op) (updated map[string]interface{}, removed []string) {
+	if op.UpdateDescription == nil {
+		return
+	}
+	if u, ok := op.UpdateDescription["updatedFields"].(map[string]interface{}); ok {
+		updated = u
+	}
+	switch r := op.UpdateDescription["removedFields"].(type) {
+	case primitive.A:
+		for _, f := range r {
+			if name, ok := f.(string); ok {
+				removed = append(removed, name)
+			}
+		}
+	case []interface{}:
+		for _, f := range r {
+			if name, ok := f.(string); ok {
+				removed = append(removed, name)
+			}
+		}
+	}
+	return
+}
+
+// touched reports whether the field at path k was changed by an update of paths
+func touched(paths []string, k string) bool {
+	for _, p := range paths {
+		if p == k || strings.HasPrefix(k, p+".") || strings.HasPrefix(p, k+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// changedPaths returns the paths changed by op when only changed fields are mapped,
+// or nil if the whole document applies
+func (im *InfluxMeasure) changedPaths(op *gtm.Op) []string {
+	if im.updates != updatesChanged || !op.IsUpdate() {
+		return nil
+	}
+	updated, removed := updateDescription(op)
+	if updated == nil && removed == nil {
+		// oplog tailing does not carry an update description
+		return nil
+	}
+	paths := make([]string, 0, len(updated)+len(removed))
+	for k := range updated {
+		paths = append(paths, k)
+	}
+	for _, k := range removed {
+		if im.touchesFields([]string{k}) {
+			// a removed field cannot be written so the fields the document still has are mapped
+			return nil
+		}
+		paths = append(paths, k)
+	}
+	return paths
+}
+
+// touchesFields reports whether an update of paths changed any mapped field
+func (im *InfluxMeasure) touchesFields(paths []string) bool {
+	for k := range im.fields {
+		if touched(paths, k) {
+			return true
+		}
+	}
+	return false
+}
+
 func (ctx *InfluxCtx) lookupInView(orig *gtm.Op, view *dbcol) (op *gtm.Op, err error) {
 	col := ctx.client.Database(view.db).Collection(view.col)
 	result := col.FindOne(context.Background(), bson.M{
@@ -434,65 +756,167 @@ func (ctx *InfluxCtx) lookupInView(orig *gtm.Op, view *dbcol) (op *gtm.Op, err e
 	return
 }
 
+// mappingFailed records a document that could not be mapped in the dead letter destination
+func (ctx *InfluxCtx) mappingFailed(op *gtm.Op, reason string, err error) error {
+	stats.mappingFailed(reason)
+	if ctx.dead != nil {
+		if derr := ctx.dead.Add(newDeadLetterRecord(op, err)); derr != nil {
+			return fmt.Errorf("%s (unable to save dead letter: %s)", err, derr)
+		}
+	}
+	return err
+}
+
+// deleteSeries drops the series tagged with the _id of a deleted document. The delete
+// is kept until it succeeds and holds back the resume timestamp until then
+func (ctx *InfluxCtx) deleteSeries(op *gtm.Op, measure *InfluxMeasure) error {
+	d, ok := deleterOf(ctx.sinkFor(measure))
+	if !ok {
+		return fmt.Errorf("Output does not support deleting series for %s", op.Namespace)
+	}
+	name := measure.measure
+	if measure.measureTpl != nil {
+		// the name may depend on the deleted document so match any measurement
+		name = ""
+	}
+	id, err := measure.idTag(op.Id)
+	if err != nil {
+		return ctx.mappingFailed(op, "document", err)
+	}
+	// buffered points are written first so that none of them outlive the delete
+	ctx.deletes = append(ctx.deletes, &seriesDelete{
+		deleter:     d,
+		before:      ctx.m,
+		database:    measure.database,
+		retention:   measure.retention,
+		measurement: name,
+		tags:        map[string]string{measure.tags["_id"]: id},
+	})
+	ctx.m = make(map[*InfluxMeasure]client.BatchPoints)
+	return ctx.writeBatch()
+}
+
 func (ctx *InfluxCtx) addPoint(op *gtm.Op) error {
-	measure := ctx.measures[op.Namespace]
-	if measure != nil {
-		if measure.view != nil && op.IsSourceOplog() {
-			var err error
-			op, err = ctx.lookupInView(op, measure.view)
-			if err != nil {
-				return err
-			}
+	stats.opReceived(op.Namespace, op.Operation)
+	var token *resumeToken
+	measures := ctx.measuresFor(op.Namespace)
+	if t := takeToken(op); t != nil && len(measures) > 0 {
+		token = &resumeToken{ns: streamKey(ownerStream(ctx.config.streams, op.Namespace)), token: t, ts: op.Timestamp}
+	}
+	if len(measures) == 0 {
+		ctx.skipTs(op)
+		return nil
+	}
+	var err error
+	for _, measure := range measures {
+		// a failed measurement does not keep the document from the others
+		if merr := ctx.addMeasurePoints(op, measure); merr != nil && err == nil {
+			err = merr
 		}
-		if err := ctx.setupDatabase(op); err != nil {
+	}
+	// failed ops are tracked too so that the checkpoint waits for the points kept for them
+	ctx.trackTs(op, token)
+	return err
+}
+
+// addMeasurePoints maps op to the points of a single measurement
+func (ctx *InfluxCtx) addMeasurePoints(op *gtm.Op, measure *InfluxMeasure) error {
+	deleted := op.IsDelete()
+	if deleted {
+		switch measure.deletes {
+		case "":
+			return nil
+		case deletesSeries:
+			return ctx.deleteSeries(op, measure)
+		}
+	}
+	changed := measure.changedPaths(op)
+	if changed != nil && measure.plug == nil {
+		if !measure.touchesFields(changed) {
+			// none of the mapped fields were changed by this update
+			return nil
+		}
+		if len(op.Data) == 0 {
+			// the document is gone so map the updated fields alone
+			o := *op
+			o.Data, _ = updateDescription(op)
+			op = &o
+		}
+	}
+	if measure.view != nil && op.IsSourceOplog() && !deleted {
+		var err error
+		op, err = ctx.lookupInView(op, measure.view)
+		if err != nil {
 			return err
 		}
-		bp := ctx.m[op.Namespace]
-		mapper := &InfluxDataMap{
-			op:      op,
-			measure: measure,
-			name:    measure.measure,
-			nameTpl: measure.measureTpl,
-		}
-		if measure.plug != nil {
-			points, err := measure.plug(&mongofluxdplug.MongoDocument{
-				Data:       op.Data,
-				Namespace:  op.Namespace,
-				Database:   op.GetDatabase(),
-				Collection: op.GetCollection(),
-				Operation:  op.Operation,
-			})
-			if err != nil {
-				return err
+	}
+	if measure.filter != nil && !deleted && !measure.filter(op.Data) {
+		return nil
+	}
+	if err := ctx.setupDatabase(measure); err != nil {
+		return err
+	}
+	bp := ctx.m[measure]
+	mapper := &InfluxDataMap{
+		op:      op,
+		measure: measure,
+		name:    measure.measure,
+		nameTpl: measure.measureTpl,
+		changed: changed,
+	}
+	if measure.plug != nil && !(deleted && measure.deletes == deletesTombstone) {
+		updated, removed := updateDescription(op)
+		points, err := measure.plug(&mongofluxdplug.MongoDocument{
+			Id:            op.Id,
+			Data:          op.Data,
+			Namespace:     op.Namespace,
+			Database:      op.GetDatabase(),
+			Collection:    op.GetCollection(),
+			Operation:     op.Operation,
+			UpdatedFields: updated,
+			RemovedFields: removed,
+		})
+		if err != nil {
+			return ctx.mappingFailed(op, "plugin", err)
+		}
+		for _, pt := range points {
+			if err := mapper.resolveName(pt.Tags, pt.Fields, op.Data); err != nil {
+				return ctx.mappingFailed(op, "measurement", err)
 			}
-			for _, pt := range points {
-				if err := mapper.resolveName(pt.Tags, pt.Fields, op.Data); err != nil {
-					return err
-				}
-				pt, err := client.NewPoint(mapper.name, pt.Tags, pt.Fields, pt.Timestamp)
-				if err != nil {
-					return err
-				}
-				bp.AddPoint(pt)
+			pt, err := client.NewPoint(mapper.name, pt.Tags, pt.Fields, pt.Timestamp)
+			if err != nil {
+				return ctx.mappingFailed(op, "point", err)
 			}
+			bp.AddPoint(pt)
+		}
+	} else {
+		var err error
+		if deleted {
+			err = mapper.tombstone()
 		} else {
-			if err := mapper.loadData(); err != nil {
-				return err
-			}
-			if err := mapper.resolveName(mapper.tags, mapper.fields, op.Data); err != nil {
-				return err
+			err = mapper.loadData()
+		}
+		if err != nil {
+			return ctx.mappingFailed(op, "document", err)
+		}
+		mappers, err := mapper.explode()
+		if err != nil {
+			return ctx.mappingFailed(op, "array", err)
+		}
+		for _, em := range mappers {
+			if err := em.resolveName(em.tags, em.fields, op.Data); err != nil {
+				return ctx.mappingFailed(op, "measurement", err)
 			}
-			pt, err := client.NewPoint(mapper.name, mapper.tags, mapper.fields, mapper.t)
+			pt, err := client.NewPoint(em.name, em.tags, em.fields, em.t)
 			if err != nil {
-				return err
+				return ctx.mappingFailed(op, "point", err)
 			}
 			bp.AddPoint(pt)
 		}
-		ctx.lastTs = op.Timestamp
-		if len(bp.Points()) >= ctx.config.InfluxBufferSize {
-			if err := ctx.writeBatch(); err != nil {
-				return err
-			}
+	}
+	if len(bp.Points()) >= ctx.config.InfluxBufferSize {
+		if err := ctx.writeBatch(); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -502,40 +926,62 @@ func IsInsertOrUpdate(op *gtm.Op) bool {
 	return op.IsInsert() || op.IsUpdate()
 }
 
+func (config *configOptions) onlyOpTypes() gtm.OpFilter {
+	var deletes []*measureSettings
+	for _, m := range config.Measurement {
+		if m.Deletes != "" {
+			deletes = append(deletes, m)
+		}
+	}
+	return func(op *gtm.Op) bool {
+		if IsInsertOrUpdate(op) {
+			return true
+		}
+		if op.IsDelete() {
+			for _, m := range deletes {
+				if m.matches(op.Namespace) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
 func NotMongoFlux(op *gtm.Op) bool {
 	return op.GetDatabase() != Name
 }
 
-func saveTimestamp(client *mongo.Client, ts primitive.Timestamp, config *configOptions) error {
-	col := client.Database(Name).Collection("resume")
-	doc := map[string]interface{}{
-		"ts": ts,
+func (m *measureSettings) matches(ns string) bool {
+	if m.nsPattern != nil {
+		return m.nsPattern.MatchString(ns)
 	}
-	opts := options.Update()
-	opts.SetUpsert(true)
-	_, err := col.UpdateOne(context.Background(), bson.M{
-		"_id": config.ResumeName,
-	}, bson.M{
-		"$set": doc,
-	}, opts)
-	return err
+	return m.Namespace == ns || (m.View != "" && m.View == ns)
 }
 
 func (config *configOptions) onlyMeasured() gtm.OpFilter {
-	if config.ChangeStreams {
-		return func(op *gtm.Op) bool {
-			return true
-		}
-	}
 	measured := make(map[string]bool)
+	var patterns []*measureSettings
 	for _, m := range config.Measurement {
+		if m.nsPattern != nil {
+			patterns = append(patterns, m)
+			continue
+		}
 		measured[m.Namespace] = true
 		if m.View != "" {
 			measured[m.View] = true
 		}
 	}
 	return func(op *gtm.Op) bool {
-		return measured[op.Namespace]
+		if measured[op.Namespace] {
+			return true
+		}
+		for _, m := range patterns {
+			if m.matches(op.Namespace) {
+				return true
+			}
+		}
+		return false
 	}
 }
 
@@ -543,12 +989,19 @@ func (config *configOptions) ParseCommandLineFlags() *configOptions {
 	flag.StringVar(&config.InfluxURL, "influx-url", "", "InfluxDB connection URL")
 	flag.StringVar(&config.InfluxUser, "influx-user", "", "InfluxDB user name")
 	flag.StringVar(&config.InfluxPassword, "influx-password", "", "InfluxDB user password")
+	flag.StringVar(&config.InfluxPasswordFile, "influx-password-file", "", "File to read the InfluxDB user password from")
+	flag.StringVar(&config.InfluxOrg, "influx-org", "", "InfluxDB 2.X organization. Setting an org or token enables the v2 write API")
+	flag.StringVar(&config.InfluxToken, "influx-token", "", "InfluxDB 2.X API token")
+	flag.StringVar(&config.InfluxTokenFile, "influx-token-file", "", "File to read the InfluxDB 2.X API token from")
+	flag.StringVar(&config.InfluxUDPAddr, "influx-udp-addr", "", "Address host:port of an InfluxDB UDP listener to write all points to")
+	flag.IntVar(&config.InfluxUDPPayloadSize, "influx-udp-payload-size", 0, "The maximum size of a UDP packet sent to InfluxDB. Defaults to 512")
 	flag.BoolVar(&config.InfluxSkipVerify, "influx-skip-verify", false, "Set true to skip https certificate validation for InfluxDB")
 	flag.BoolVar(&config.InfluxAutoCreateDB, "influx-auto-create-db", true, "Set false to disable automatic database creation on InfluxDB")
 	flag.StringVar(&config.InfluxPemFile, "influx-pem-file", "", "Path to a PEM file for secure connections to InfluxDB")
 	flag.IntVar(&config.InfluxClients, "influx-clients", 0, "The number of concurrent InfluxDB clients")
 	flag.IntVar(&config.InfluxBufferSize, "influx-buffer-size", 0, "After this number of points the batch is flushed to InfluxDB")
 	flag.StringVar(&config.MongoURL, "mongo-url", "", "MongoDB connection URL")
+	flag.StringVar(&config.MongoURLFile, "mongo-url-file", "", "File to read the MongoDB connection URL from")
 	flag.StringVar(&config.MongoOpLogDatabaseName, "mongo-oplog-database-name", "", "Override the database name which contains the mongodb oplog")
 	flag.StringVar(&config.MongoOpLogCollectionName, "mongo-oplog-collection-name", "", "Override the collection name which contains the mongodb oplog")
 	flag.StringVar(&config.ConfigFile, "f", "", "Location of configuration file")
@@ -559,11 +1012,39 @@ func (config *configOptions) ParseCommandLineFlags() *configOptions {
 	flag.BoolVar(&config.ResumeWriteUnsafe, "resume-write-unsafe", false, "True to speedup writes of the last timestamp synched for resuming at the cost of error checking")
 	flag.BoolVar(&config.Replay, "replay", false, "True to replay all events from the oplog and index them in elasticsearch")
 	flag.StringVar(&config.ResumeName, "resume-name", "", "Name under which to load/store the resume state. Defaults to 'default'")
+	flag.StringVar(&config.ResumeStore, "resume-store", "", "Where to store the resume state: mongo (default), file:/path or influx")
 	flag.StringVar(&config.PluginPath, "plugin-path", "", "The file path to a .so file plugin")
 	flag.BoolVar(&config.DirectReads, "direct-reads", false, "Set to true to read directly from MongoDB collections")
 	flag.BoolVar(&config.ChangeStreams, "change-streams", false, "Set to true to enable change streams for MongoDB 3.6+")
 	flag.BoolVar(&config.ExitAfterDirectReads, "exit-after-direct-reads", false, "Set to true to exit after direct reads are complete")
-	flag.Parse()
+	flag.StringVar(&config.SpoolDir, "spool-dir", "", "Directory to spool points to on disk while the output is unavailable")
+	flag.Int64Var(&config.SpoolMaxSize, "spool-max-size", 0, "The maximum size in bytes of the spool directory. Defaults to unlimited")
+	flag.StringVar(&config.SpoolFullPolicy, "spool-full-policy", "", "What to do when the spool is full: block (default) or drop-oldest")
+	flag.StringVar(&config.DeadLetter, "dead-letter", "", "Where to save documents that fail mapping: mongo for the mongofluxd.deadletter collection or file:/path for a JSONL file")
+	flag.BoolVar(&config.DryRun, "dry-run", false, "True to log the points that would be written instead of writing them")
+	flag.StringVar(&config.MetricsAddr, "metrics-addr", "", "Address host:port to serve Prometheus metrics on /metrics and health checks on /healthz and /readyz")
+	flag.StringVar(&config.Output, "output", "", "Where to write points: influx (default), stdout, or file:/path to write line protocol, or remote-write:URL for Prometheus")
+	flag.IntVar(&config.GtmSettings.ChannelSize, "gtm-settings.channel-size", 0, "The size of the channels gtm passes ops on")
+	flag.IntVar(&config.GtmSettings.BufferSize, "gtm-settings.buffer-size", 0, "The number of documents gtm buffers before fetching them in a batch")
+	flag.StringVar(&config.GtmSettings.BufferDuration, "gtm-settings.buffer-duration", "", "How long gtm buffers documents before fetching them in a batch")
+	flag.IntVar(&config.RetrySettings.MaxAttempts, "retry-settings.max-attempts", 0, "The number of attempts to write a batch")
+	flag.StringVar(&config.RetrySettings.Backoff, "retry-settings.backoff", "", "The backoff after the first failed write, doubled after each attempt")
+	flag.StringVar(&config.RetrySettings.MaxBackoff, "retry-settings.max-backoff", "", "The maximum backoff between attempts")
+	flag.Float64Var(&config.RetrySettings.Jitter, "retry-settings.jitter", 0, "Randomize each backoff by up to this fraction")
+	config.measurementFlags()
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "validate" {
+		config.validate = true
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	if flag.Arg(0) == "validate" {
+		config.validate = true
+	}
+	config.given = make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		config.given[f.Name] = true
+	})
 	return config
 }
 
@@ -574,106 +1055,100 @@ func (config *configOptions) LoadPlugin() *configOptions {
 		}
 		return config
 	}
+	if err := config.loadPluginSymbols(); err != nil {
+		errorLog.Panicln(err)
+	}
+	if config.Verbose {
+		infoLog.Printf("plugin <%s> loaded succesfully\n", config.PluginPath)
+	}
+	return config
+}
+
+// loadPluginSymbols looks up the plugin symbol of each measurement
+func (config *configOptions) loadPluginSymbols() error {
+	if config.PluginPath == "" {
+		return nil
+	}
 	p, err := plugin.Open(config.PluginPath)
 	if err != nil {
-		errorLog.Panicf("Unable to load plugin <%s>: %s", config.PluginPath, err)
+		return fmt.Errorf("Unable to load plugin <%s>: %s", config.PluginPath, err)
 	}
 	for _, m := range config.Measurement {
 		if m.Symbol != "" {
 			f, err := p.Lookup(m.Symbol)
 			if err != nil {
-				errorLog.Panicf("Unable to lookup symbol <%s> for plugin <%s>: %s", m.Symbol, config.PluginPath, err)
+				return fmt.Errorf("Unable to lookup symbol <%s> for plugin <%s>: %s", m.Symbol, config.PluginPath, err)
 			}
 			switch f.(type) {
 			case func(*mongofluxdplug.MongoDocument) ([]*mongofluxdplug.InfluxPoint, error):
 				m.plug = f.(func(*mongofluxdplug.MongoDocument) ([]*mongofluxdplug.InfluxPoint, error))
 			default:
-				errorLog.Panicf("Plugin symbol <%s> must be typed %T", m.Symbol, m.plug)
+				return fmt.Errorf("Plugin symbol <%s> must be typed %T", m.Symbol, m.plug)
 			}
 		}
 	}
-	if config.Verbose {
-		infoLog.Printf("plugin <%s> loaded succesfully\n", config.PluginPath)
+	return nil
+}
+
+// decodeConfigFile reads the TOML configuration file at path into config.
+// Options missing from the file keep the values they have in config
+func decodeConfigFile(path string, config *configOptions) (toml.MetaData, error) {
+	md, err := toml.DecodeFile(path, config)
+	if err != nil {
+		return md, err
 	}
-	return config
+	return md, expandStrings(reflect.ValueOf(config).Elem(), "")
 }
 
-func (config *configOptions) LoadConfigFile() *configOptions {
+// load layers the defaults in config with the configuration file, the environment
+// and the flags, in increasing precedence. Only the flags given on the command line
+// are taken from flags. It returns the options of the configuration file that are unknown
+func (config *configOptions) load(flags *configOptions) (unknown []string, err error) {
+	given := flags.given
+	// the configuration file is not an option of the file, so this is the one
+	// variable that is not derived from the name of a field
+	config.ConfigFile = os.Getenv(envName("config-file"))
+	if given["f"] {
+		config.ConfigFile = flags.ConfigFile
+	}
 	if config.ConfigFile != "" {
-		var tomlConfig configOptions = configOptions{
-			GtmSettings:        GtmDefaultSettings(),
-			InfluxAutoCreateDB: true,
-		}
-		if _, err := toml.DecodeFile(config.ConfigFile, &tomlConfig); err != nil {
-			panic(err)
-		}
-		if config.InfluxURL == "" {
-			config.InfluxURL = tomlConfig.InfluxURL
-		}
-		if config.InfluxClients == 0 {
-			config.InfluxClients = tomlConfig.InfluxClients
-		}
-		if config.InfluxBufferSize == 0 {
-			config.InfluxBufferSize = tomlConfig.InfluxBufferSize
-		}
-		if config.InfluxUser == "" {
-			config.InfluxUser = tomlConfig.InfluxUser
-		}
-		if config.InfluxPassword == "" {
-			config.InfluxPassword = tomlConfig.InfluxPassword
-		}
-		if config.InfluxSkipVerify == false {
-			config.InfluxSkipVerify = tomlConfig.InfluxSkipVerify
-		}
-		if config.InfluxAutoCreateDB == true {
-			if tomlConfig.InfluxAutoCreateDB == false {
-				config.InfluxAutoCreateDB = false
-			}
-		}
-		if config.InfluxPemFile == "" {
-			config.InfluxPemFile = tomlConfig.InfluxPemFile
-		}
-		if config.MongoURL == "" {
-			config.MongoURL = tomlConfig.MongoURL
-		}
-		if config.MongoOpLogDatabaseName == "" {
-			config.MongoOpLogDatabaseName = tomlConfig.MongoOpLogDatabaseName
-		}
-		if config.MongoOpLogCollectionName == "" {
-			config.MongoOpLogCollectionName = tomlConfig.MongoOpLogCollectionName
-		}
-		if !config.Verbose && tomlConfig.Verbose {
-			config.Verbose = true
-		}
-		if !config.Replay && tomlConfig.Replay {
-			config.Replay = true
-		}
-		if !config.DirectReads && tomlConfig.DirectReads {
-			config.DirectReads = true
-		}
-		if !config.ChangeStreams && tomlConfig.ChangeStreams {
-			config.ChangeStreams = true
-		}
-		if !config.ExitAfterDirectReads && tomlConfig.ExitAfterDirectReads {
-			config.ExitAfterDirectReads = true
-		}
-		if !config.Resume && tomlConfig.Resume {
-			config.Resume = true
-		}
-		if !config.ResumeWriteUnsafe && tomlConfig.ResumeWriteUnsafe {
-			config.ResumeWriteUnsafe = true
-		}
-		if config.ResumeFromTimestamp == 0 {
-			config.ResumeFromTimestamp = tomlConfig.ResumeFromTimestamp
+		md, err := decodeConfigFile(config.ConfigFile, config)
+		if err != nil {
+			return nil, err
 		}
-		if config.Resume && config.ResumeName == "" {
-			config.ResumeName = tomlConfig.ResumeName
+		for _, key := range md.Undecoded() {
+			unknown = append(unknown, key.String())
 		}
-		if config.PluginPath == "" {
-			config.PluginPath = tomlConfig.PluginPath
+		if err = config.loadSecretFiles(config.ConfigFile, func(option string) bool {
+			return md.IsDefined(option)
+		}); err != nil {
+			return nil, err
 		}
-		config.GtmSettings = tomlConfig.GtmSettings
-		config.Measurement = tomlConfig.Measurement
+	}
+	if err = config.loadEnv(); err != nil {
+		return
+	}
+	if err = config.loadSecretFiles("the environment", func(option string) bool {
+		_, ok := os.LookupEnv(envName(option))
+		return ok
+	}); err != nil {
+		return
+	}
+	if err = config.applyFlags(flags, given); err != nil {
+		return
+	}
+	return unknown, config.loadSecretFiles("the flags", func(option string) bool {
+		return given[option]
+	})
+}
+
+func (config *configOptions) LoadConfig(flags *configOptions) *configOptions {
+	unknown, err := config.load(flags)
+	if err != nil {
+		errorLog.Panicf("Configuration error: %s", err)
+	}
+	for _, key := range unknown {
+		errorLog.Printf("Ignoring unknown option %s in %s", key, config.ConfigFile)
 	}
 	return config
 }
@@ -783,34 +1258,51 @@ func GtmDefaultSettings() gtmSettings {
 	}
 }
 
-func saveTimestampFromReplStatus(client *mongo.Client, config *configOptions) {
+func saveTimestampFromReplStatus(client *mongo.Client, ckpt *checkpoint) {
 	if rs, err := gtm.GetReplStatus(client); err == nil {
 		var ts primitive.Timestamp
 		if ts, err = rs.GetLastCommitted(); err == nil {
-			saveTimestamp(client, ts, config)
+			if err = ckpt.advance(ts); err != nil {
+				errorLog.Printf("Unable to save timestamp: %s", err)
+			}
 		}
 	}
 }
 
 func main() {
-	config := &configOptions{
-		GtmSettings: GtmDefaultSettings(),
-	}
-	config.ParseCommandLineFlags()
-	if config.Version {
+	config := newConfig()
+	flags := (&configOptions{}).ParseCommandLineFlags()
+	if flags.Version {
 		fmt.Println(Version)
 		os.Exit(0)
 	}
-	config.LoadConfigFile().SetDefaults().LoadPlugin()
+	if flags.validate {
+		config.runValidate(flags)
+	}
+	config.LoadConfig(flags).SetDefaults().LoadPlugin()
+	if config.DryRun {
+		// nothing is written outside of the log
+		config.SpoolDir = ""
+		config.DeadLetter = ""
+	}
 
 	if len(config.Measurement) == 0 {
 		errorLog.Panicf("at least one measurement is required")
 	}
+	if err := config.compileNamespaces(); err != nil {
+		errorLog.Panicf("Configuration error: %s", err)
+	}
+	if err := config.compileFilters(); err != nil {
+		errorLog.Panicf("Configuration error: %s", err)
+	}
 
 	sigs := make(chan os.Signal, 1)
 	stopC := make(chan bool, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
 	defer signal.Stop(sigs)
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	defer signal.Stop(hups)
 
 	mongoClient, err := config.DialMongo()
 	if err != nil {
@@ -823,6 +1315,16 @@ func main() {
 		stopC <- true
 	}()
 
+	var store CheckpointStore
+	if config.Resume {
+		if store, err = config.NewCheckpointStore(mongoClient); err != nil {
+			errorLog.Panicf("Unable to open resume store %s: %s", config.ResumeStore, err)
+		}
+		if config.DryRun {
+			store = &dryRunStore{store}
+		}
+	}
+
 	var after gtm.TimestampGenerator = nil
 	if config.Replay {
 		after = func(client *mongo.Client, options *gtm.Options) (primitive.Timestamp, error) {
@@ -837,18 +1339,9 @@ func main() {
 		}
 	} else if config.Resume {
 		after = func(client *mongo.Client, options *gtm.Options) (primitive.Timestamp, error) {
-			var ts primitive.Timestamp
-			col := client.Database(Name).Collection("resume")
-			result := col.FindOne(context.Background(), bson.M{
-				"_id": config.ResumeName,
-			})
-			if err = result.Err(); err == nil {
-				doc := make(map[string]interface{})
-				if err = result.Decode(&doc); err == nil {
-					if doc["ts"] != nil {
-						ts = doc["ts"].(primitive.Timestamp)
-					}
-				}
+			ts, err := store.LoadTimestamp()
+			if err != nil {
+				errorLog.Printf("Unable to load resume timestamp: %s", err)
 			}
 			if ts.T == 0 {
 				ts, _ = gtm.LastOpTimestamp(client, options)
@@ -859,46 +1352,52 @@ func main() {
 	}
 
 	var filter gtm.OpFilter = nil
-	filterChain := []gtm.OpFilter{NotMongoFlux, config.onlyMeasured(), IsInsertOrUpdate}
+	measured := newLiveFilter(config.measuredFilter())
+	filterChain := []gtm.OpFilter{NotMongoFlux, measured.filter}
 	filter = gtm.ChainOpFilters(filterChain...)
 	gtmBufferDuration, err := time.ParseDuration(config.GtmSettings.BufferDuration)
 	if err != nil {
 		errorLog.Panicf("Unable to parse gtm buffer duration %s: %s", config.GtmSettings.BufferDuration, err)
 	}
-	httpConfig := client.HTTPConfig{
-		UserAgent:          fmt.Sprintf("%s v%s", Name, Version),
-		Addr:               config.InfluxURL,
-		Username:           config.InfluxUser,
-		Password:           config.InfluxPassword,
-		InsecureSkipVerify: config.InfluxSkipVerify,
+	sink, err := config.NewSink()
+	if err != nil {
+		errorLog.Panicf("Unable to create InfluxDB client: %s", err)
 	}
-	if config.InfluxPemFile != "" {
-		tlsConfig, err := config.InfluxTLS()
-		if err != nil {
-			errorLog.Panicf("Unable to configure TLS for InfluxDB: %s", err)
+	retry, err := config.NewRetrier()
+	if err != nil {
+		errorLog.Panicf("Configuration error: %s", err)
+	}
+	if config.SpoolDir != "" {
+		if sink, err = newSpoolSink(sink, config, retry); err != nil {
+			errorLog.Panicf("Unable to open spool directory %s: %s", config.SpoolDir, err)
 		}
-		httpConfig.TLSConfig = tlsConfig
 	}
-	influxClient, err := client.NewHTTPClient(httpConfig)
+	measureSinks, err := config.LoadMeasureSinks()
 	if err != nil {
-		errorLog.Panicf("Unable to create InfluxDB client: %s", err)
+		errorLog.Panicf("Unable to create InfluxDB UDP client: %s", err)
+	}
+	if errs := config.checkMeasurements(sink); len(errs) > 0 {
+		errorLog.Panicf("Configuration error: %s", joinErrors(errs))
+	}
+	deadLetter, err := config.NewDeadLetter(mongoClient)
+	if err != nil {
+		errorLog.Panicf("Unable to open dead letter destination %s: %s", config.DeadLetter, err)
 	}
 	var directReadNs, changeStreamNs []string
 	if config.DirectReads {
-		for _, m := range config.Measurement {
-			if m.View != "" {
-				directReadNs = append(directReadNs, m.View)
-			} else {
-				directReadNs = append(directReadNs, m.Namespace)
-			}
+		if directReadNs, err = config.directReadNamespaces(mongoClient); err != nil {
+			errorLog.Panicf("Unable to list collections for direct reads: %s", err)
 		}
 	}
 	if config.ChangeStreams {
-		for _, m := range config.Measurement {
-			changeStreamNs = append(changeStreamNs, m.Namespace)
-		}
+		changeStreamNs = config.changeStreamNamespaces(nil)
 	}
-	gtmCtx := gtm.Start(mongoClient, &gtm.Options{
+	ordering := gtm.AnyOrder
+	if config.Resume {
+		// ops must reach the workers in oplog order for the checkpoint to hold back every one in flight
+		ordering = gtm.Oplog
+	}
+	gtmOptions := &gtm.Options{
 		After:               after,
 		Log:                 infoLog,
 		NamespaceFilter:     filter,
@@ -906,37 +1405,79 @@ func main() {
 		OpLogDatabaseName:   config.MongoOpLogDatabaseName,
 		OpLogCollectionName: config.MongoOpLogCollectionName,
 		ChannelSize:         config.GtmSettings.ChannelSize,
-		Ordering:            gtm.AnyOrder,
+		Ordering:            ordering,
 		WorkerCount:         4,
 		BufferDuration:      gtmBufferDuration,
 		BufferSize:          config.GtmSettings.BufferSize,
 		DirectReadNs:        directReadNs,
 		ChangeStreamNs:      changeStreamNs,
-	})
+		Pipe:                config.filterPipe(),
+	}
+	ckpt := newCheckpoint(store)
+	stats.follow(ckpt)
+	var gtmCtx *opCtx
+	if len(changeStreamNs) > 0 && config.Resume && !config.Replay && config.ResumeFromTimestamp == 0 {
+		// resume each change stream from its own token
+		if gtmCtx, err = startTokenOpCtx(mongoClient, gtmOptions, ckpt); err != nil {
+			errorLog.Panicf("Unable to load change stream resume tokens: %s", err)
+		}
+	} else {
+		gtmCtx = startOpCtx(mongoClient, gtmOptions, ckpt, nil)
+	}
 	var wg sync.WaitGroup
+	var started int32
+	reloads := &reloader{
+		config:   config,
+		client:   mongoClient,
+		sink:     sink,
+		options:  gtmOptions,
+		gtmCtx:   gtmCtx,
+		measured: measured,
+		read:     make(map[string]bool),
+		switched: make(chan struct{}, config.InfluxClients),
+		sinks:    measureSinks,
+		done:     make(chan struct{}),
+	}
+	for _, ns := range directReadNs {
+		reloads.read[ns] = true
+	}
 	for i := 1; i <= config.InfluxClients; i++ {
 		wg.Add(1)
-		go func() {
+		reloadC := make(chan *configOptions)
+		reloads.workers = append(reloads.workers, reloadC)
+		go func(id int) {
 			defer wg.Done()
 			flusher := time.NewTicker(1 * time.Second)
 			defer flusher.Stop()
 			influx := &InfluxCtx{
-				c:        influxClient,
-				m:        make(map[string]client.BatchPoints),
+				id:       id,
+				sink:     sink,
+				m:        make(map[*InfluxMeasure]client.BatchPoints),
 				dbs:      make(map[string]bool),
-				measures: make(map[string]*InfluxMeasure),
+				measures: make(map[string][]*InfluxMeasure),
+				resolved: make(map[string][]*InfluxMeasure),
 				config:   config,
+				retry:    retry,
+				tokens:   make(map[string]*resumeToken),
+				ckpt:     ckpt,
 				client:   mongoClient,
+				dead:     deadLetter,
 			}
 			if err := influx.setupMeasurements(); err != nil {
 				errorLog.Panicf("Configuration error: %s", err)
 			}
+			atomic.AddInt32(&started, 1)
 			for {
 				select {
 				case <-flusher.C:
 					if err := influx.writeBatch(); err != nil {
 						gtmCtx.ErrC <- err
 					}
+				case next := <-reloadC:
+					if err := influx.reload(next); err != nil {
+						gtmCtx.ErrC <- err
+					}
+					reloads.switched <- struct{}{}
 				case err = <-gtmCtx.ErrC:
 					if err == nil {
 						break
@@ -959,6 +1500,21 @@ func main() {
 					}
 				}
 			}
+		}(i)
+	}
+	go reloads.run(hups)
+	if config.MetricsAddr != "" {
+		health := &healthChecks{
+			client: mongoClient,
+			sink:   sink,
+			ready: func() bool {
+				return int(atomic.LoadInt32(&started)) == config.InfluxClients
+			},
+		}
+		go func() {
+			if err := serveMetrics(config.MetricsAddr, health); err != nil {
+				errorLog.Printf("Unable to serve metrics on %s: %s", config.MetricsAddr, err)
+			}
 		}()
 	}
 	if config.DirectReads {
@@ -966,7 +1522,7 @@ func main() {
 			gtmCtx.DirectReadWg.Wait()
 			infoLog.Println("Direct reads completed")
 			if config.Resume {
-				saveTimestampFromReplStatus(mongoClient, config)
+				saveTimestampFromReplStatus(mongoClient, ckpt)
 			}
 			if config.ExitAfterDirectReads {
 				gtmCtx.Stop()
@@ -977,8 +1533,13 @@ func main() {
 	}
 	<-stopC
 	infoLog.Println("Stopping all workers and shutting down")
+	signal.Stop(hups)
 	gtmCtx.Stop()
 	mongoClient.Disconnect(context.Background())
-	influxClient.Close()
+	sink.Close()
+	reloads.close()
+	if deadLetter != nil {
+		deadLetter.Close()
+	}
 	os.Exit(exitStatus)
 }
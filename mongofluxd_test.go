@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"github.com/influxdata/influxdb1-client/v2"
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"testing"
+)
+
+func testDelete(id string, ts uint32) *gtm.Op {
+	return &gtm.Op{
+		Id:        id,
+		Namespace: "db.col",
+		Operation: "d",
+		Source:    gtm.OplogQuerySource,
+		Timestamp: primitive.Timestamp{T: ts, I: 1},
+	}
+}
+
+func TestTombstoneRejectsDocumentTemplate(t *testing.T) {
+	for _, measure := range []string{"col_{{.Doc.region}}", "col_{{ .Fields.v }}"} {
+		ms := testMeasurement()
+		ms.Deletes = deletesTombstone
+		ms.Measure = measure
+		config := newConfig()
+		config.Measurement = []*measureSettings{ms}
+		if errs := config.checkMeasurements(&memorySink{}); len(errs) == 0 {
+			t.Fatalf("expected measure %s to be rejected with tombstones", measure)
+		}
+	}
+}
+
+func TestDeleteSeriesRequiresDeletingOutput(t *testing.T) {
+	ms := testMeasurement()
+	ms.Deletes = deletesSeries
+	config := newConfig()
+	config.Measurement = []*measureSettings{ms}
+	if errs := config.checkMeasurements(&spoolSink{inner: &memorySink{}}); len(errs) == 0 {
+		t.Fatal("expected a spool over an output that cannot delete series to be rejected")
+	}
+	if errs := config.checkMeasurements(&spoolSink{inner: &deletingSink{}}); len(errs) != 0 {
+		t.Fatalf("expected a spool over a deleting output to be accepted, got %v", errs)
+	}
+}
+
+func TestTombstoneTemplate(t *testing.T) {
+	ms := testMeasurement()
+	ms.Deletes = deletesTombstone
+	ms.Measure = "{{.Database}}_{{.Collection}}"
+	sink := &memorySink{}
+	ctx := newTestCtx(t, sink, 1, ms)
+	if err := ctx.addPoint(testDelete("a", 100)); err != nil {
+		t.Fatal(err)
+	}
+	lines := sink.lines()
+	if want := "db_col,id=a deleted=true 100000000000"; len(lines) != 1 || lines[0] != want {
+		t.Fatalf("expected %q, got %v", want, lines)
+	}
+}
+
+// deletingSink records the writes and series deletes applied, in order
+type deletingSink struct {
+	memorySink
+	deleteErr error
+	events    []string
+}
+
+func (s *deletingSink) Write(bp client.BatchPoints) error {
+	if err := s.memorySink.Write(bp); err != nil {
+		return err
+	}
+	for _, p := range bp.Points() {
+		s.events = append(s.events, "write "+p.String())
+	}
+	return nil
+}
+
+func (s *deletingSink) DeleteSeries(db, rp, measurement string, tags map[string]string) error {
+	if s.deleteErr != nil {
+		return s.deleteErr
+	}
+	s.events = append(s.events, "delete "+influxQLDelete(measurement, tags))
+	return nil
+}
+
+func TestDeleteSeriesKeptUntilApplied(t *testing.T) {
+	ms := testMeasurement()
+	ms.Deletes = deletesSeries
+	sink := &deletingSink{deleteErr: errors.New("timeout")}
+	ctx := newTestCtx(t, sink, 10, ms)
+	store := &memoryStore{}
+	ctx.config.Resume = true
+	ctx.ckpt = newCheckpoint(store)
+	if err := ctx.addPoint(testInsert("a", 1, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.addPoint(testDelete("a", 101)); err == nil {
+		t.Fatal("expected the failed delete to be reported")
+	}
+	if err := ctx.addPoint(testInsert("a", 2, 102)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.writeBatch(); err == nil {
+		t.Fatal("expected the delete to fail again")
+	}
+	if len(store.saved) != 0 {
+		t.Fatalf("expected no checkpoint while the delete is pending, got %v", store.saved)
+	}
+	sink.deleteErr = nil
+	if err := ctx.writeBatch(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"write col,id=a v=1i 100000000000",
+		`delete DELETE FROM "col" WHERE "id" = 'a'`,
+		"write col,id=a v=2i 102000000000",
+	}
+	if !reflect.DeepEqual(sink.events, want) {
+		t.Fatalf("expected %q, got %q", want, sink.events)
+	}
+	if saved, _ := store.LoadTimestamp(); saved != (primitive.Timestamp{T: 102, I: 1}) {
+		t.Fatalf("expected the checkpoint to move past the delete once applied, got %+v", saved)
+	}
+}
+
+func TestRejectedDeleteSeriesDropped(t *testing.T) {
+	ms := testMeasurement()
+	ms.Deletes = deletesSeries
+	sink := &deletingSink{deleteErr: &rejectedError{err: errors.New("bad request")}}
+	ctx := newTestCtx(t, sink, 10, ms)
+	store := &memoryStore{}
+	ctx.config.Resume = true
+	ctx.ckpt = newCheckpoint(store)
+	if err := ctx.addPoint(testInsert("a", 1, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.addPoint(testDelete("a", 101)); err == nil {
+		t.Fatal("expected the rejected delete to be reported")
+	}
+	if len(ctx.deletes) != 0 {
+		t.Fatalf("expected the rejected delete to be dropped, got %d pending", len(ctx.deletes))
+	}
+	if err := ctx.addPoint(testInsert("a", 2, 102)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.writeBatch(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"write col,id=a v=1i 100000000000",
+		"write col,id=a v=2i 102000000000",
+	}
+	if !reflect.DeepEqual(sink.events, want) {
+		t.Fatalf("expected %q, got %q", want, sink.events)
+	}
+	if n := bufferedPoints(ctx); n != 0 {
+		t.Fatalf("expected the buffer to be empty, got %d points", n)
+	}
+	if saved, _ := store.LoadTimestamp(); saved != (primitive.Timestamp{T: 102, I: 1}) {
+		t.Fatalf("expected the checkpoint to move past the rejected delete, got %+v", saved)
+	}
+}
+
+func testUpdate(data map[string]interface{}, updated map[string]interface{}, removed ...interface{}) *gtm.Op {
+	return &gtm.Op{
+		Id:        "a",
+		Namespace: "db.col",
+		Operation: "u",
+		Source:    gtm.OplogQuerySource,
+		Timestamp: primitive.Timestamp{T: 100, I: 1},
+		Data:      data,
+		UpdateDescription: map[string]interface{}{
+			"updatedFields": updated,
+			"removedFields": primitive.A(removed),
+		},
+	}
+}
+
+func TestUpdatesChanged(t *testing.T) {
+	tests := []struct {
+		name string
+		op   *gtm.Op
+		want []string
+	}{
+		{
+			name: "updated field",
+			op:   testUpdate(map[string]interface{}{"_id": "a", "v": 2, "w": 5}, map[string]interface{}{"v": 2}),
+			want: []string{"col,id=a v=2i 100000000000"},
+		},
+		{
+			name: "unmapped field updated",
+			op:   testUpdate(map[string]interface{}{"_id": "a", "v": 2, "x": 1}, map[string]interface{}{"x": 1}),
+		},
+		{
+			name: "mapped field removed",
+			op:   testUpdate(map[string]interface{}{"_id": "a", "v": 2}, map[string]interface{}{}, "w"),
+			want: []string{"col,id=a v=2i 100000000000"},
+		},
+		{
+			name: "unmapped field removed",
+			op:   testUpdate(map[string]interface{}{"_id": "a", "v": 2, "w": 5}, map[string]interface{}{}, "x"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := testMeasurement()
+			ms.Fields = []string{"v", "w"}
+			ms.Updates = updatesChanged
+			sink := &memorySink{}
+			ctx := newTestCtx(t, sink, 1, ms)
+			if err := ctx.addPoint(tt.op); err != nil {
+				t.Fatal(err)
+			}
+			if got := sink.lines(); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
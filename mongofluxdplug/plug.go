@@ -15,11 +15,14 @@ import "time"
 // to enable the plugin start with mongofluxd -plugin-path /path/to/myplugin.so
 
 type MongoDocument struct {
-	Data       map[string]interface{} // the original document data from MongoDB
-	Database   string                 // the origin database in MongoDB
-	Collection string                 // the origin collection in MongoDB
-	Namespace  string                 // the entire namespace for the original document
-	Operation  string                 // "i" for a insert or "u" for update
+	Id            interface{}            // the _id of the document
+	Data          map[string]interface{} // the original document data from MongoDB, nil for a delete
+	Database      string                 // the origin database in MongoDB
+	Collection    string                 // the origin collection in MongoDB
+	Namespace     string                 // the entire namespace for the original document
+	Operation     string                 // "i" for a insert, "u" for update or "d" for delete when deletes = "plugin"
+	UpdatedFields map[string]interface{} // for updates from change streams the values set by the update keyed by dotted path
+	RemovedFields []string               // for updates from change streams the dotted paths removed by the update
 }
 
 type InfluxPoint struct {
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"regexp"
+	"strings"
+)
+
+func isWildcard(ns string) bool {
+	return strings.ContainsAny(ns, "*?")
+}
+
+// wildcardRegexp translates a namespace with * and ? wildcards to a regular
+// expression capturing what each wildcard matched. Wildcards in the database
+// name do not match across the dot separating the collection name
+func wildcardRegexp(ns string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	inDb := true
+	for _, r := range ns {
+		switch r {
+		case '*':
+			if inDb {
+				b.WriteString("([^.]*)")
+			} else {
+				b.WriteString("(.*)")
+			}
+		case '?':
+			if inDb {
+				b.WriteString("([^.])")
+			} else {
+				b.WriteString("(.)")
+			}
+		case '.':
+			inDb = false
+			b.WriteString(`\.`)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// compileNamespaces compiles the wildcard and regex namespaces of measurements
+func (config *configOptions) compileNamespaces() error {
+	for _, m := range config.Measurement {
+		var err error
+		if m.NamespaceRegex != "" {
+			if m.Namespace != "" {
+				return fmt.Errorf("namespace %s and namespace-regex %s cannot both be set", m.Namespace, m.NamespaceRegex)
+			}
+			m.nsPattern, err = regexp.Compile(m.NamespaceRegex)
+		} else if isWildcard(m.Namespace) {
+			m.nsPattern, err = wildcardRegexp(m.Namespace)
+		} else if !strings.Contains(m.Namespace, ".") {
+			return fmt.Errorf("namespace %s must be of the form db.collection", m.Namespace)
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid namespace pattern: %s", err)
+		}
+		if m.nsPattern != nil && m.View != "" {
+			return fmt.Errorf("a view cannot be set for the namespace pattern %s", m.pattern())
+		}
+	}
+	return nil
+}
+
+// pattern returns the namespace as configured
+func (m *measureSettings) pattern() string {
+	if m.NamespaceRegex != "" {
+		return m.NamespaceRegex
+	}
+	return m.Namespace
+}
+
+// watchNs returns the namespace a change stream must watch for the measurement:
+// the collection, the database when only the collection name has wildcards,
+// or the whole deployment
+func (m *measureSettings) watchNs() string {
+	if m.nsPattern == nil {
+		return m.Namespace
+	}
+	if m.NamespaceRegex == "" {
+		if db := strings.SplitN(m.Namespace, ".", 2)[0]; !isWildcard(db) {
+			return db
+		}
+	}
+	return ""
+}
+
+// coversNs reports whether the change stream watching stream delivers the changes of ns
+func coversNs(stream, ns string) bool {
+	if stream == "" || stream == ns {
+		return true
+	}
+	return !strings.Contains(stream, ".") && strings.HasPrefix(ns, stream+".")
+}
+
+// watching reports whether one of streams delivers the changes of ns
+func watching(streams []string, ns string) bool {
+	for _, s := range streams {
+		if coversNs(s, ns) {
+			return true
+		}
+	}
+	return false
+}
+
+// ownerStream returns the first of streams that delivers the changes of ns.
+// When streams overlap the changes delivered by the others are skipped
+func ownerStream(streams []string, ns string) string {
+	for _, s := range streams {
+		if coversNs(s, ns) {
+			return s
+		}
+	}
+	return ""
+}
+
+// changeStreamNamespaces returns the namespaces to watch with change streams in
+// addition to the running streams. Namespaces are widened to the database or
+// deployment when a measurement needs the wider stream, so that a change is not
+// seen twice when a wider stream covers a collection
+func (config *configOptions) changeStreamNamespaces(running []string) []string {
+	watched := make(map[string]bool)
+	var unwatched []*measureSettings
+	for _, m := range config.Measurement {
+		if ns := m.watchNs(); !watching(running, ns) {
+			watched[ns] = true
+			unwatched = append(unwatched, m)
+		}
+	}
+	var nss []string
+	added := make(map[string]bool)
+	for _, m := range unwatched {
+		ns := m.watchNs()
+		if watched[""] {
+			ns = ""
+		} else if db := strings.SplitN(ns, ".", 2)[0]; db != ns && watched[db] {
+			ns = db
+		}
+		if !added[ns] {
+			nss = append(nss, ns)
+			added[ns] = true
+		}
+	}
+	config.streams = append(append([]string(nil), running...), nss...)
+	return nss
+}
+
+// streamsInUse returns the running streams that are the owner of a namespace
+// measured by config. Stopping the others does not change the owner of any
+// measured namespace
+func (config *configOptions) streamsInUse(running []string) map[string]bool {
+	inUse := make(map[string]bool)
+	for _, m := range config.Measurement {
+		w := m.watchNs()
+		if watching(running, w) {
+			inUse[ownerStream(running, w)] = true
+		}
+		for _, s := range running {
+			if !coversNs(w, s) {
+				continue
+			}
+			if strings.Contains(s, ".") && !m.matches(s) {
+				continue
+			}
+			inUse[ownerStream(running, s)] = true
+		}
+	}
+	return inUse
+}
+
+// directReadNamespaces returns the namespaces to read directly. Namespace
+// patterns are matched against the collections that currently exist
+func (config *configOptions) directReadNamespaces(client *mongo.Client) ([]string, error) {
+	var nss []string
+	var patterns []*measureSettings
+	seen := make(map[string]bool)
+	add := func(ns string) {
+		// measurements sharing a namespace are fed by a single read
+		if !seen[ns] {
+			nss = append(nss, ns)
+			seen[ns] = true
+		}
+	}
+	for _, m := range config.Measurement {
+		if m.nsPattern != nil {
+			patterns = append(patterns, m)
+		} else if m.View != "" {
+			add(m.View)
+		} else {
+			add(m.Namespace)
+		}
+	}
+	if len(patterns) == 0 {
+		return nss, nil
+	}
+	dbs, err := client.ListDatabaseNames(context.Background(), bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	for _, db := range dbs {
+		switch db {
+		case "admin", "config", "local", Name:
+			continue
+		}
+		cols, err := listCollections(client, db)
+		if err != nil {
+			return nil, err
+		}
+		for _, col := range cols {
+			ns := db + "." + col
+			for _, m := range patterns {
+				if m.nsPattern.MatchString(ns) {
+					add(ns)
+					break
+				}
+			}
+		}
+	}
+	return nss, nil
+}
+
+func listCollections(client *mongo.Client, db string) ([]string, error) {
+	cursor, err := client.Database(db).ListCollections(context.Background(), bson.M{"type": "collection"})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	var cols []string
+	for cursor.Next(context.Background()) {
+		var info struct {
+			Name string `bson:"name"`
+		}
+		if err = cursor.Decode(&info); err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(info.Name, "system.") {
+			cols = append(cols, info.Name)
+		}
+	}
+	return cols, cursor.Err()
+}
+
+// measuresFor returns the measurements for ns, instantiating the pattern
+// measurements matching ns the first time it is seen
+func (ctx *InfluxCtx) measuresFor(ns string) []*InfluxMeasure {
+	if len(ctx.patterns) == 0 {
+		return ctx.measures[ns]
+	}
+	if ims, found := ctx.resolved[ns]; found {
+		return ims
+	}
+	ims := append([]*InfluxMeasure(nil), ctx.measures[ns]...)
+	for _, p := range ctx.patterns {
+		if match := p.pattern.FindStringSubmatch(ns); match != nil {
+			ims = append(ims, p.instance(ns, match))
+		}
+	}
+	ctx.resolved[ns] = ims
+	return ims
+}
+
+// instance returns a copy of a pattern measurement for the namespace ns
+func (im *InfluxMeasure) instance(ns string, match []string) *InfluxMeasure {
+	c := *im
+	c.ns = ns
+	c.match = match
+	names := strings.SplitN(ns, ".", 2)
+	if c.database == "" {
+		c.database = names[0]
+	}
+	if c.measure == "" {
+		c.measure = names[1]
+	}
+	return &c
+}
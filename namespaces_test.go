@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStreamsInUse(t *testing.T) {
+	tests := []struct {
+		name    string
+		nss     []string
+		running []string
+		want    map[string]bool
+	}{
+		{"removed collection", []string{"db.a"}, []string{"db.a", "db.b"}, map[string]bool{"db.a": true}},
+		{"database covers collection", []string{"db.a", "db.*"}, []string{"db", "db.a"}, map[string]bool{"db": true}},
+		{"collection before database", []string{"db.a", "db.*"}, []string{"db.a", "db"}, map[string]bool{"db.a": true, "db": true}},
+		{"pattern removed", []string{"db.a"}, []string{"db.a", "other"}, map[string]bool{"db.a": true}},
+		{"deployment", []string{"*.a"}, []string{"", "db.b"}, map[string]bool{"": true}},
+		{"collection matched by deployment", []string{"*.a"}, []string{"db.a", ""}, map[string]bool{"db.a": true, "": true}},
+		{"new namespace", []string{"db.c"}, []string{"db.a"}, map[string]bool{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := newConfig()
+			for _, ns := range tt.nss {
+				config.Measurement = append(config.Measurement, &measureSettings{Namespace: ns})
+			}
+			if err := config.compileNamespaces(); err != nil {
+				t.Fatal(err)
+			}
+			if got := config.streamsInUse(tt.running); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestWildcardRegexp(t *testing.T) {
+	tests := []struct {
+		pattern string
+		ns      string
+		match   bool
+		groups  []string
+	}{
+		{"db.*", "db.orders", true, []string{"orders"}},
+		{"db.*", "db.orders.archive", true, []string{"orders.archive"}},
+		{"db.*", "dbx.orders", false, nil},
+		{"db.orders_?", "db.orders_1", true, []string{"1"}},
+		{"db.orders_?", "db.orders_10", false, nil},
+		{"*.orders", "shop.orders", true, []string{"shop"}},
+		{"*.orders", "shop.eu.orders", false, nil},
+		{"s?op.*", "shop.orders", true, []string{"h", "orders"}},
+		{"s?op.*", "s.op.orders", false, nil},
+		{"db.a.b*", "db.aXb1", false, nil},
+		{"db.a.b*", "db.a.b1", true, []string{"1"}},
+		{"db+1.c(1)*", "db+1.c(1)x", true, []string{"x"}},
+		{"db+1.c(1)*", "dbb1.c1x", false, nil},
+	}
+	for _, tt := range tests {
+		re, err := wildcardRegexp(tt.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := re.FindStringSubmatch(tt.ns)
+		if (m != nil) != tt.match {
+			t.Fatalf("expected %s matching %s to be %v", tt.pattern, tt.ns, tt.match)
+		}
+		if m != nil && !reflect.DeepEqual(m[1:], tt.groups) {
+			t.Fatalf("expected %s to capture %v from %s, got %v", tt.pattern, tt.groups, tt.ns, m[1:])
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/mongo"
+	"sync"
+	"sync/atomic"
+)
+
+// opCtx presents one or more gtm contexts to the workers as a single stream
+// of ops and errors. Each change stream runs in a context of its own so that
+// it can be stopped when its namespaces are no longer measured
+type opCtx struct {
+	OpC          gtm.OpChan
+	ErrC         chan error
+	DirectReadWg *sync.WaitGroup
+	contexts     []*gtm.OpCtx
+	opWg         sync.WaitGroup
+	lock         sync.Mutex
+	stopped      bool
+	// streams holds the namespaces of the running change streams, in order
+	streams   atomic.Value
+	streamCtx map[string]*gtm.OpCtx
+	// resumer starts change streams from their saved tokens when resuming
+	resumer *tokenResumer
+	// ckpt is told about each op passed on
+	ckpt *checkpoint
+}
+
+// opForwarder copies ops from a child context and reports whether to pass each one on
+type opForwarder func(op *gtm.Op) bool
+
+// startOpCtx starts a context for the oplog and direct reads of options and one
+// for each of its change streams
+func startOpCtx(client *mongo.Client, options *gtm.Options, ckpt *checkpoint, resumer *tokenResumer) *opCtx {
+	multi := &opCtx{
+		OpC:       make(gtm.OpChan, options.ChannelSize),
+		ErrC:      make(chan error, options.ChannelSize),
+		streamCtx: make(map[string]*gtm.OpCtx),
+		resumer:   resumer,
+		ckpt:      ckpt,
+	}
+	multi.streams.Store([]string(nil))
+	direct := *options
+	direct.ChangeStreamNs = nil
+	multi.DirectReadWg = multi.start(client, &direct, nil).DirectReadWg
+	multi.watch(client, options, options.ChangeStreamNs)
+	return multi
+}
+
+func (multi *opCtx) start(client *mongo.Client, o *gtm.Options, forward opForwarder) *gtm.OpCtx {
+	ctx := gtm.Start(client, o)
+	multi.contexts = append(multi.contexts, ctx)
+	multi.opWg.Add(2)
+	go func(c gtm.OpChan) {
+		defer multi.opWg.Done()
+		for op := range c {
+			if op != nil && (forward == nil || forward(op)) {
+				if multi.ckpt != nil {
+					// the op holds back the checkpoint until a worker has buffered it
+					multi.ckpt.enter(op)
+				}
+				multi.OpC <- op
+			}
+		}
+	}(ctx.OpC)
+	go func(c chan error) {
+		defer multi.opWg.Done()
+		for err := range c {
+			multi.ErrC <- err
+		}
+	}(ctx.ErrC)
+	return ctx
+}
+
+// watched returns the namespaces of the running change streams, in order
+func (multi *opCtx) watched() []string {
+	return multi.streams.Load().([]string)
+}
+
+// owns passes on the changes the change stream watching stream is the owner of
+// among the running streams. Changes covered by an earlier stream are skipped
+func (multi *opCtx) owns(stream string) opForwarder {
+	return func(op *gtm.Op) bool {
+		return !op.IsSourceOplog() || ownerStream(multi.watched(), op.Namespace) == stream
+	}
+}
+
+// add starts a context while the workers are running and merges its ops
+func (multi *opCtx) add(client *mongo.Client, o *gtm.Options) {
+	multi.lock.Lock()
+	defer multi.lock.Unlock()
+	if multi.stopped {
+		return
+	}
+	multi.start(client, o, nil)
+}
+
+// watch starts a change stream for each of nss after the running ones
+func (multi *opCtx) watch(client *mongo.Client, base *gtm.Options, nss []string) {
+	multi.lock.Lock()
+	defer multi.lock.Unlock()
+	if multi.stopped || len(nss) == 0 {
+		return
+	}
+	multi.streams.Store(append(append([]string(nil), multi.watched()...), nss...))
+	for _, ns := range nss {
+		o := *base
+		o.OpLogDisabled = true
+		o.DirectReadNs = nil
+		o.ChangeStreamNs = []string{ns}
+		forward := multi.owns(ns)
+		if multi.resumer != nil {
+			o = *multi.resumer.streamOptions(base, ns)
+			forward = chainForwarders(multi.resumer.forward(ns), forward)
+		}
+		multi.streamCtx[ns] = multi.start(client, &o, forward)
+	}
+}
+
+// unwatch stops the change streams of nss
+func (multi *opCtx) unwatch(nss []string) {
+	var stopping []*gtm.OpCtx
+	multi.lock.Lock()
+	stop := make(map[*gtm.OpCtx]bool)
+	for _, ns := range nss {
+		if c := multi.streamCtx[ns]; c != nil {
+			stop[c] = true
+			stopping = append(stopping, c)
+			delete(multi.streamCtx, ns)
+		}
+	}
+	var contexts []*gtm.OpCtx
+	for _, c := range multi.contexts {
+		if !stop[c] {
+			contexts = append(contexts, c)
+		}
+	}
+	multi.contexts = contexts
+	var streams []string
+	for _, ns := range multi.watched() {
+		if _, ok := multi.streamCtx[ns]; ok {
+			streams = append(streams, ns)
+		}
+	}
+	multi.streams.Store(streams)
+	multi.lock.Unlock()
+	// the ops already read are still passed on before their forwarders exit
+	for _, c := range stopping {
+		c.Stop()
+	}
+}
+
+func (multi *opCtx) Stop() {
+	multi.lock.Lock()
+	defer multi.lock.Unlock()
+	if multi.stopped {
+		return
+	}
+	multi.stopped = true
+	for _, c := range multi.contexts {
+		c.Stop()
+	}
+	multi.opWg.Wait()
+	close(multi.OpC)
+	close(multi.ErrC)
+}
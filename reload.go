@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"github.com/influxdata/influxdb1-client/v2"
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/mongo"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// liveFilter is an op filter that can be replaced while gtm is running
+type liveFilter struct {
+	v atomic.Value
+}
+
+func newLiveFilter(f gtm.OpFilter) *liveFilter {
+	lf := &liveFilter{}
+	lf.set(f)
+	return lf
+}
+
+func (lf *liveFilter) set(f gtm.OpFilter) {
+	lf.v.Store(f)
+}
+
+func (lf *liveFilter) filter(op *gtm.Op) bool {
+	return lf.v.Load().(gtm.OpFilter)(op)
+}
+
+// measuredFilter passes the ops of the namespaces and operations measured
+func (config *configOptions) measuredFilter() gtm.OpFilter {
+	return gtm.ChainOpFilters(config.onlyMeasured(), config.onlyOpTypes())
+}
+
+// chainForwarders passes on the ops that every one of forwarders passes on
+func chainForwarders(forwarders ...opForwarder) opForwarder {
+	return func(op *gtm.Op) bool {
+		for _, f := range forwarders {
+			if f != nil && !f(op) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// reloadMeasurements reads the measurements of the configuration file again.
+// Other settings keep the values the process was started with
+func (config *configOptions) reloadMeasurements() (*configOptions, error) {
+	if config.ConfigFile == "" {
+		return nil, fmt.Errorf("no configuration file was given with -f")
+	}
+	tomlConfig := &configOptions{}
+	if _, err := decodeConfigFile(config.ConfigFile, tomlConfig); err != nil {
+		return nil, err
+	}
+	next := *config
+	next.Measurement = tomlConfig.Measurement
+	if config.cliMeasurement != nil {
+		// the measurement given with flags is kept
+		m := *config.cliMeasurement
+		next.Measurement = append(next.Measurement, &m)
+	}
+	if len(next.Measurement) == 0 {
+		return nil, fmt.Errorf("at least one measurement is required")
+	}
+	if err := next.loadPluginSymbols(); err != nil {
+		return nil, err
+	}
+	if err := next.compileNamespaces(); err != nil {
+		return nil, err
+	}
+	if err := next.compileFilters(); err != nil {
+		return nil, err
+	}
+	return &next, nil
+}
+
+// reload rebuilds the measurements of a worker. Batches buffered for the previous
+// measurements are flushed first since their UDP sinks are closed once every
+// worker has reloaded. Batches that could not be written are kept for the next
+// flush, except those for a UDP sink which are dropped
+func (ctx *InfluxCtx) reload(next *configOptions) error {
+	err := ctx.writeBatch()
+	ctx.dropMeasureSinkBatches(ctx.m)
+	for _, d := range ctx.deletes {
+		ctx.dropMeasureSinkBatches(d.before)
+	}
+	ctx.config = next
+	ctx.measures = make(map[string][]*InfluxMeasure)
+	ctx.patterns = nil
+	ctx.resolved = make(map[string][]*InfluxMeasure)
+	if serr := ctx.setupMeasurements(); serr != nil {
+		return serr
+	}
+	return err
+}
+
+// dropMeasureSinkBatches removes the batches in m written to a measurement sink
+func (ctx *InfluxCtx) dropMeasureSinkBatches(m map[*InfluxMeasure]client.BatchPoints) {
+	for measure, bp := range m {
+		if measure.sink != nil {
+			delete(m, measure)
+			errorLog.Printf("Dropped %d points for %s on reload", len(bp.Points()), measure.ns)
+		}
+	}
+}
+
+// reloader applies the measurements of the configuration file on SIGHUP without
+// restarting gtm. Namespaces no longer measured are filtered out, change streams
+// no longer needed are stopped and change streams or direct reads are started
+// for the namespaces that are new
+type reloader struct {
+	lock     sync.Mutex
+	config   *configOptions
+	client   *mongo.Client
+	sink     Sink
+	options  *gtm.Options
+	gtmCtx   *opCtx
+	measured *liveFilter
+	workers  []chan *configOptions
+	read     map[string]bool
+	// workers signal switched once they have applied a reload
+	switched chan struct{}
+	// sinks are the measurement sinks in use
+	sinks []Sink
+	done  chan struct{}
+}
+
+func (r *reloader) run(hups chan os.Signal) {
+	for range hups {
+		if err := r.reload(); err != nil {
+			errorLog.Printf("Unable to reload measurements, keeping the current ones: %s", err)
+		}
+	}
+}
+
+func (r *reloader) reload() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	infoLog.Printf("Reloading measurements from %s", r.config.ConfigFile)
+	next, err := r.config.reloadMeasurements()
+	if err != nil {
+		return err
+	}
+	sinks, err := next.LoadMeasureSinks()
+	if err != nil {
+		closeSinks(sinks)
+		return err
+	}
+	if errs := next.checkMeasurements(r.sink); len(errs) > 0 {
+		closeSinks(sinks)
+		return fmt.Errorf("%s", joinErrors(errs))
+	}
+	var streams, stopped, direct []string
+	if next.ChangeStreams {
+		inUse := next.streamsInUse(r.config.streams)
+		var kept []string
+		for _, ns := range r.config.streams {
+			if inUse[ns] {
+				kept = append(kept, ns)
+			} else {
+				stopped = append(stopped, ns)
+			}
+		}
+		streams = next.changeStreamNamespaces(kept)
+	}
+	if next.DirectReads {
+		nss, err := next.directReadNamespaces(r.client)
+		if err != nil {
+			closeSinks(sinks)
+			return fmt.Errorf("Unable to list collections for direct reads: %s", err)
+		}
+		for _, ns := range nss {
+			if !r.read[ns] {
+				direct = append(direct, ns)
+				r.read[ns] = true
+			}
+		}
+	}
+	// workers know the new measurements before any of their ops are let through
+	for _, w := range r.workers {
+		select {
+		case w <- next:
+		case <-r.done:
+			closeSinks(sinks)
+			return fmt.Errorf("shutting down")
+		}
+	}
+	// the previous sinks are unused once every worker has switched to the new ones
+	for range r.workers {
+		select {
+		case <-r.switched:
+		case <-r.done:
+			closeSinks(sinks)
+			return fmt.Errorf("shutting down")
+		}
+	}
+	closeSinks(r.sinks)
+	r.sinks = sinks
+	r.measured.set(next.measuredFilter())
+	r.gtmCtx.unwatch(stopped)
+	r.start(next, direct, streams)
+	r.config = next
+	infoLog.Printf("Reloaded %d measurements, %d new change streams, %d stopped change streams and %d new direct reads",
+		len(next.Measurement), len(streams), len(stopped), len(direct))
+	return nil
+}
+
+// start reads the namespaces added by a reload
+func (r *reloader) start(next *configOptions, direct, streams []string) {
+	base := *r.options
+	base.OpLogDisabled = true
+	base.DirectReadNs = nil
+	base.ChangeStreamNs = nil
+	base.Pipe = next.filterPipe()
+	if len(direct) > 0 {
+		o := base
+		o.DirectReadNs = direct
+		r.gtmCtx.add(r.client, &o)
+	}
+	r.gtmCtx.watch(r.client, &base, streams)
+}
+
+// close stops reloading and closes the measurement sinks in use
+func (r *reloader) close() {
+	close(r.done)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	closeSinks(r.sinks)
+	r.sinks = nil
+}
+
+func closeSinks(sinks []Sink) {
+	for _, s := range sinks {
+		s.Close()
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReloadFlushesMeasureSinks(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		written  int
+		buffered int
+	}{
+		{"flushed", nil, 1, 0},
+		{"dropped when the write fails", errors.New("timeout"), 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			udp := &memorySink{}
+			ms := testMeasurement()
+			ms.sink = udp
+			other := testMeasurement()
+			other.Measure = "other"
+			sink := &memorySink{}
+			ctx := newTestCtx(t, sink, 10, ms, other)
+			if err := ctx.addPoint(testInsert("a", 1, 100)); err != nil {
+				t.Fatal(err)
+			}
+			udp.setErr(tt.err)
+			sink.setErr(tt.err)
+			next := newConfig()
+			next.Measurement = []*measureSettings{testMeasurement()}
+			if err := ctx.reload(next); (err != nil) != (tt.err != nil) {
+				t.Fatalf("expected the flush error %v, got %v", tt.err, err)
+			}
+			if n := len(udp.lines()); n != tt.written {
+				t.Fatalf("expected %d points written to the UDP sink, got %d", tt.written, n)
+			}
+			if n := bufferedPoints(ctx); n != tt.buffered {
+				t.Fatalf("expected %d buffered points, got %d", tt.buffered, n)
+			}
+			for measure := range ctx.m {
+				if measure.sink != nil {
+					t.Fatal("expected no batch to be kept for the UDP sink")
+				}
+			}
+		})
+	}
+}
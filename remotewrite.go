@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/influxdata/influxdb1-client/v2"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// remoteWriteSink turns points into Prometheus remote-write samples.
+// Each field of a point becomes a series named <measure>_<field> labeled by the point tags
+type remoteWriteSink struct {
+	url        string
+	useragent  string
+	httpClient *http.Client
+}
+
+type promLabel struct {
+	name  string
+	value string
+}
+
+type promSample struct {
+	value float64
+	ts    int64
+}
+
+type promSeries struct {
+	labels  []promLabel
+	samples []promSample
+}
+
+// promName replaces characters not allowed in Prometheus metric and label names
+func promName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || r == '_' || r == ':' || (i > 0 && r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+func promValue(v interface{}) (float64, bool) {
+	switch vt := v.(type) {
+	case float64:
+		return vt, true
+	case int64:
+		return float64(vt), true
+	case uint64:
+		return float64(vt), true
+	case bool:
+		if vt {
+			return 1, true
+		}
+		return 0, true
+	default:
+		return 0, false
+	}
+}
+
+func (s *remoteWriteSink) series(bp client.BatchPoints) ([]*promSeries, error) {
+	var keys []string
+	series := make(map[string]*promSeries)
+	for _, p := range bp.Points() {
+		if p == nil {
+			continue
+		}
+		fields, err := p.Fields()
+		if err != nil {
+			return nil, err
+		}
+		var labels []promLabel
+		for k, v := range p.Tags() {
+			labels = append(labels, promLabel{name: promName(k), value: v})
+		}
+		ts := p.Time().UnixNano() / int64(1e6)
+		for f, v := range fields {
+			value, ok := promValue(v)
+			if !ok {
+				// strings cannot be represented as samples
+				continue
+			}
+			ls := append([]promLabel{{name: "__name__", value: promName(p.Name() + "_" + f)}}, labels...)
+			sort.Slice(ls, func(i, j int) bool {
+				return ls[i].name < ls[j].name
+			})
+			var key strings.Builder
+			for _, l := range ls {
+				key.WriteString(l.name)
+				key.WriteByte(0)
+				key.WriteString(l.value)
+				key.WriteByte(0)
+			}
+			k := key.String()
+			ser := series[k]
+			if ser == nil {
+				ser = &promSeries{labels: ls}
+				series[k] = ser
+				keys = append(keys, k)
+			}
+			ser.samples = append(ser.samples, promSample{value: value, ts: ts})
+		}
+	}
+	var out []*promSeries
+	for _, k := range keys {
+		ser := series[k]
+		sort.SliceStable(ser.samples, func(i, j int) bool {
+			return ser.samples[i].ts < ser.samples[j].ts
+		})
+		out = append(out, ser)
+	}
+	return out, nil
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendBytesField(b []byte, field int, data []byte) []byte {
+	b = appendVarint(b, uint64(field<<3|2))
+	b = appendVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// encodeWriteRequest encodes the series as a prometheus.WriteRequest protobuf message
+func encodeWriteRequest(series []*promSeries) []byte {
+	var req, ts, msg []byte
+	for _, ser := range series {
+		ts = ts[:0]
+		for _, l := range ser.labels {
+			msg = msg[:0]
+			msg = appendBytesField(msg, 1, []byte(l.name))
+			msg = appendBytesField(msg, 2, []byte(l.value))
+			ts = appendBytesField(ts, 1, msg)
+		}
+		for _, sample := range ser.samples {
+			msg = msg[:0]
+			msg = appendVarint(msg, 1<<3|1)
+			var value [8]byte
+			binary.LittleEndian.PutUint64(value[:], math.Float64bits(sample.value))
+			msg = append(msg, value[:]...)
+			msg = appendVarint(msg, 2<<3|0)
+			msg = appendVarint(msg, uint64(sample.ts))
+			ts = appendBytesField(ts, 2, msg)
+		}
+		req = appendBytesField(req, 1, ts)
+	}
+	return req
+}
+
+func (s *remoteWriteSink) Write(bp client.BatchPoints) error {
+	series, err := s.series(bp)
+	if err != nil {
+		return err
+	}
+	if len(series) == 0 {
+		return nil
+	}
+	body := snappy.Encode(nil, encodeWriteRequest(series))
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", s.useragent)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		err = fmt.Errorf("remote write returned status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+		if rejectedStatus(resp.StatusCode) {
+			return &rejectedError{err: err}
+		}
+		return err
+	}
+	return nil
+}
+
+// CreateDatabase is a no-op since Prometheus has no databases
+func (s *remoteWriteSink) CreateDatabase(db, rp string) error {
+	return nil
+}
+
+func (s *remoteWriteSink) Close() error {
+	return nil
+}
+
+func (config *configOptions) newRemoteWriteSink(addr string) (Sink, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("Unsupported protocol scheme: %s, your address must start with http:// or https://", u.Scheme)
+	}
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: config.InfluxSkipVerify,
+		},
+	}
+	if config.InfluxPemFile != "" {
+		tlsConfig, err := config.InfluxTLS()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to configure TLS for remote write: %s", err)
+		}
+		tr.TLSClientConfig = tlsConfig
+	}
+	return &remoteWriteSink{
+		url:        addr,
+		useragent:  fmt.Sprintf("%s v%s", Name, Version),
+		httpClient: &http.Client{Transport: tr},
+	}, nil
+}
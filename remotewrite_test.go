@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/influxdata/influxdb1-client/v2"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// protoField is a field of a decoded protobuf message
+type protoField struct {
+	num   int
+	wire  int
+	value uint64
+	data  []byte
+}
+
+func readVarint(b []byte) (uint64, int, error) {
+	var v uint64
+	for i := 0; i < len(b) && i < 10; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * uint(i))
+		if b[i] < 0x80 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("truncated varint")
+}
+
+// decodeProto splits a protobuf message into its fields
+func decodeProto(b []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(b) > 0 {
+		key, n, err := readVarint(b)
+		if err != nil {
+			return nil, err
+		}
+		b = b[n:]
+		f := protoField{num: int(key >> 3), wire: int(key & 7)}
+		switch f.wire {
+		case 0:
+			if f.value, n, err = readVarint(b); err != nil {
+				return nil, err
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return nil, fmt.Errorf("truncated fixed64")
+			}
+			f.value = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case 2:
+			l, n, err := readVarint(b)
+			if err != nil {
+				return nil, err
+			}
+			b = b[n:]
+			if uint64(len(b)) < l {
+				return nil, fmt.Errorf("truncated bytes")
+			}
+			f.data, b = b[:l], b[l:]
+		default:
+			return nil, fmt.Errorf("unexpected wire type %d", f.wire)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// decodeWriteRequest decodes a prometheus.WriteRequest into series
+func decodeWriteRequest(b []byte) ([]*promSeries, error) {
+	req, err := decodeProto(b)
+	if err != nil {
+		return nil, err
+	}
+	var out []*promSeries
+	for _, f := range req {
+		if f.num != 1 || f.wire != 2 {
+			return nil, fmt.Errorf("unexpected field %d in WriteRequest", f.num)
+		}
+		ts, err := decodeProto(f.data)
+		if err != nil {
+			return nil, err
+		}
+		ser := &promSeries{}
+		for _, tf := range ts {
+			msg, err := decodeProto(tf.data)
+			if err != nil {
+				return nil, err
+			}
+			switch tf.num {
+			case 1:
+				var l promLabel
+				for _, lf := range msg {
+					switch lf.num {
+					case 1:
+						l.name = string(lf.data)
+					case 2:
+						l.value = string(lf.data)
+					}
+				}
+				ser.labels = append(ser.labels, l)
+			case 2:
+				var s promSample
+				for _, sf := range msg {
+					switch sf.num {
+					case 1:
+						s.value = math.Float64frombits(sf.value)
+					case 2:
+						s.ts = int64(sf.value)
+					}
+				}
+				ser.samples = append(ser.samples, s)
+			default:
+				return nil, fmt.Errorf("unexpected field %d in TimeSeries", tf.num)
+			}
+		}
+		out = append(out, ser)
+	}
+	return out, nil
+}
+
+func TestEncodeWriteRequestGolden(t *testing.T) {
+	series := []*promSeries{{
+		labels:  []promLabel{{name: "__name__", value: "m_v"}},
+		samples: []promSample{{value: 1.5, ts: 1000}},
+	}}
+	want := []byte{
+		0x0a, 0x1f, // timeseries
+		0x0a, 0x0f, // label
+		0x0a, 0x08, '_', '_', 'n', 'a', 'm', 'e', '_', '_',
+		0x12, 0x03, 'm', '_', 'v',
+		0x12, 0x0c, // sample
+		0x09, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xf8, 0x3f,
+		0x10, 0xe8, 0x07,
+	}
+	if got := encodeWriteRequest(series); !bytes.Equal(got, want) {
+		t.Fatalf("expected % x, got % x", want, got)
+	}
+}
+
+func TestEncodeWriteRequestRoundTrip(t *testing.T) {
+	series := []*promSeries{
+		{
+			labels: []promLabel{{name: "__name__", value: "orders_total"}, {name: "region", value: "eu"}},
+			samples: []promSample{
+				{value: -2.25, ts: 1558000000000},
+				{value: 300, ts: 1558000001000},
+			},
+		},
+		{
+			labels:  []promLabel{{name: "__name__", value: "orders_open"}},
+			samples: []promSample{{value: 1, ts: 0}},
+		},
+	}
+	got, err := decodeWriteRequest(encodeWriteRequest(series))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, series) {
+		t.Fatalf("expected %+v, got %+v", series, got)
+	}
+}
+
+func TestRemoteWriteSinkWrite(t *testing.T) {
+	var body []byte
+	var headers http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		compressed, _ := ioutil.ReadAll(r.Body)
+		body, _ = snappy.Decode(nil, compressed)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	sink, err := (&configOptions{}).newRemoteWriteSink(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp, _ := client.NewBatchPoints(client.BatchPointsConfig{Database: "db"})
+	pt, err := client.NewPoint("orders", map[string]string{"region": "eu"}, map[string]interface{}{
+		"total":  int64(3),
+		"paid":   true,
+		"status": "open",
+	}, time.Unix(10, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp.AddPoint(pt)
+	if err := sink.Write(bp); err != nil {
+		t.Fatal(err)
+	}
+	if ce := headers.Get("Content-Encoding"); ce != "snappy" {
+		t.Fatalf("expected snappy encoding, got %q", ce)
+	}
+	got, err := decodeWriteRequest(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(got, func(i, j int) bool {
+		return got[i].labels[0].value < got[j].labels[0].value
+	})
+	want := []*promSeries{
+		{
+			labels:  []promLabel{{name: "__name__", value: "orders_paid"}, {name: "region", value: "eu"}},
+			samples: []promSample{{value: 1, ts: 10000}},
+		},
+		{
+			labels:  []promLabel{{name: "__name__", value: "orders_total"}, {name: "region", value: "eu"}},
+			samples: []promSample{{value: 3, ts: 10000}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"reflect"
+)
+
+const (
+	// resumeTokenField carries the change stream resume token of an event inside
+	// the document until the worker strips it
+	resumeTokenField      = "_mongofluxdResumeToken"
+	resumeTokenCollection = "tokens"
+	// keyStringTimestamp is the type byte that starts a resume token holding a cluster time
+	keyStringTimestamp = 130
+	// deploymentStream is the namespace the token of a deployment wide change stream is saved under
+	deploymentStream = "*"
+)
+
+// resumeToken is the change stream resume token of the last event seen for a namespace
+type resumeToken struct {
+	ns    string
+	token interface{}
+	ts    primitive.Timestamp
+}
+
+// tokenPipe copies the resume token of each change event into the document
+func tokenPipe(ns string, changeStream bool) ([]interface{}, error) {
+	if !changeStream {
+		return nil, nil
+	}
+	return []interface{}{
+		bson.M{"$addFields": bson.M{"fullDocument." + resumeTokenField: "$_id"}},
+	}, nil
+}
+
+// peekToken returns the resume token carried by op if there is one
+func peekToken(op *gtm.Op) interface{} {
+	if op.Data == nil {
+		return nil
+	}
+	return op.Data[resumeTokenField]
+}
+
+// takeToken removes and returns the resume token carried by op
+func takeToken(op *gtm.Op) interface{} {
+	token := peekToken(op)
+	if token != nil {
+		delete(op.Data, resumeTokenField)
+	}
+	return token
+}
+
+// streamKey returns the namespace the token of the change stream watching ns is saved under
+func streamKey(ns string) string {
+	if ns == "" {
+		return deploymentStream
+	}
+	return ns
+}
+
+func tokenData(token interface{}) interface{} {
+	switch t := token.(type) {
+	case map[string]interface{}:
+		return t["_data"]
+	case primitive.D:
+		for _, e := range t {
+			if e.Key == "_data" {
+				return e.Value
+			}
+		}
+	}
+	return nil
+}
+
+func tokensEqual(a, b interface{}) bool {
+	da, db := tokenData(a), tokenData(b)
+	return da != nil && reflect.DeepEqual(da, db)
+}
+
+// tokenTimestamp decodes the cluster time a resume token starts with
+func tokenTimestamp(token interface{}) (ts primitive.Timestamp, ok bool) {
+	var data []byte
+	switch d := tokenData(token).(type) {
+	case string:
+		var err error
+		if data, err = hex.DecodeString(d); err != nil {
+			return
+		}
+	case primitive.Binary:
+		data = d.Data
+	default:
+		return
+	}
+	if len(data) < 9 || data[0] != keyStringTimestamp {
+		return
+	}
+	ts.T = binary.BigEndian.Uint32(data[1:5])
+	ts.I = binary.BigEndian.Uint32(data[5:9])
+	return ts, true
+}
+
+// tokenResumer starts each change stream from the resume token saved for its
+// namespace, falling back to the saved timestamp when there is no usable token
+type tokenResumer struct {
+	tokens   map[string]*resumeToken
+	fallback gtm.TimestampGenerator
+}
+
+func (r *tokenResumer) after(ns string) gtm.TimestampGenerator {
+	return func(client *mongo.Client, o *gtm.Options) (primitive.Timestamp, error) {
+		if rt := r.tokens[streamKey(ns)]; rt != nil {
+			if ts, ok := tokenTimestamp(rt.token); !ok {
+				infoLog.Printf("Unable to decode resume token for %s", ns)
+			} else if first, err := gtm.FirstOpTimestamp(client, o); err == nil && tsBefore(ts, first) {
+				infoLog.Printf("Resume token for %s has expired", ns)
+			} else {
+				infoLog.Printf("Resuming %s from change stream token at %+v", ns, ts)
+				return ts, nil
+			}
+		}
+		return r.fallback(client, o)
+	}
+}
+
+// forward skips the events a stream replays before the event the saved token
+// points to, since streams restart at the cluster time of the token
+func (r *tokenResumer) forward(ns string) opForwarder {
+	rt := r.tokens[streamKey(ns)]
+	if rt == nil {
+		return nil
+	}
+	ts, ok := tokenTimestamp(rt.token)
+	if !ok {
+		return nil
+	}
+	skipping := true
+	return func(op *gtm.Op) bool {
+		if skipping {
+			if op.Timestamp == ts {
+				if tokensEqual(peekToken(op), rt.token) {
+					skipping = false
+				}
+				return false
+			} else if tsBefore(ts, op.Timestamp) {
+				skipping = false
+			}
+		}
+		return true
+	}
+}
+
+// startTokenOpCtx starts a context for direct reads and one per change stream
+// namespace so that each stream resumes from its own token
+func startTokenOpCtx(client *mongo.Client, base *gtm.Options, ckpt *checkpoint) (*opCtx, error) {
+	tokens, err := ckpt.store.LoadTokens()
+	if err != nil {
+		return nil, err
+	}
+	r := &tokenResumer{tokens: tokens, fallback: base.After}
+	return startOpCtx(client, base, ckpt, r), nil
+}
+
+// streamOptions returns the options of a context watching the single change stream ns
+func (r *tokenResumer) streamOptions(base *gtm.Options, ns string) *gtm.Options {
+	o := *base
+	o.OpLogDisabled = true
+	o.DirectReadNs = nil
+	o.ChangeStreamNs = []string{ns}
+	o.After = r.after(ns)
+	o.Pipe = tokenPipe
+	return &o
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+)
+
+// testToken returns a resume token for the cluster time ts, told apart from
+// other tokens at the same time by suffix
+func testToken(ts primitive.Timestamp, suffix string) map[string]interface{} {
+	return map[string]interface{}{"_data": fmt.Sprintf("82%08X%08X%s", ts.T, ts.I, suffix)}
+}
+
+func TestTokenTimestamp(t *testing.T) {
+	ts := primitive.Timestamp{T: 0x5cd58b2d, I: 3}
+	tests := []struct {
+		name  string
+		token interface{}
+		valid bool
+	}{
+		{"hex string", testToken(ts, "2B022C0100296E5A1004"), true},
+		{"document", primitive.D{{Key: "_data", Value: "825CD58B2D00000003"}}, true},
+		{"binary", map[string]interface{}{"_data": primitive.Binary{Data: []byte{130, 0x5c, 0xd5, 0x8b, 0x2d, 0, 0, 0, 3, 1}}}, true},
+		{"lowercase hex", map[string]interface{}{"_data": "825cd58b2d00000003"}, true},
+		{"not hex", map[string]interface{}{"_data": "82zz"}, false},
+		{"too short", map[string]interface{}{"_data": "825CD58B"}, false},
+		{"no cluster time", map[string]interface{}{"_data": "815CD58B2D00000003"}, false},
+		{"no data", map[string]interface{}{"_id": "825CD58B2D00000003"}, false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tokenTimestamp(tt.token)
+			if ok != tt.valid {
+				t.Fatalf("expected valid %v, got %v", tt.valid, ok)
+			}
+			if ok && got != ts {
+				t.Fatalf("expected %+v, got %+v", ts, got)
+			}
+		})
+	}
+}
+
+func tokenOp(ts primitive.Timestamp, token interface{}) *gtm.Op {
+	return &gtm.Op{
+		Namespace: "db.col",
+		Operation: "i",
+		Source:    gtm.OplogQuerySource,
+		Timestamp: ts,
+		Data:      map[string]interface{}{resumeTokenField: token},
+	}
+}
+
+func TestTokenResumerForward(t *testing.T) {
+	saved := primitive.Timestamp{T: 100, I: 2}
+	later := primitive.Timestamp{T: 101, I: 1}
+	r := &tokenResumer{tokens: map[string]*resumeToken{
+		"db.col": {ns: "db.col", token: testToken(saved, "B0"), ts: saved},
+	}}
+	tests := []struct {
+		name string
+		ops  []*gtm.Op
+		want []bool
+	}{
+		{
+			name: "events up to the saved one are skipped",
+			ops: []*gtm.Op{
+				tokenOp(saved, testToken(saved, "A0")),
+				tokenOp(saved, testToken(saved, "B0")),
+				tokenOp(saved, testToken(saved, "C0")),
+				tokenOp(later, testToken(later, "A0")),
+			},
+			want: []bool{false, false, true, true},
+		},
+		{
+			name: "a later event ends skipping when the saved one is gone",
+			ops: []*gtm.Op{
+				tokenOp(saved, testToken(saved, "A0")),
+				tokenOp(later, testToken(later, "A0")),
+				tokenOp(saved, testToken(saved, "C0")),
+			},
+			want: []bool{false, true, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forward := r.forward("db.col")
+			for i, op := range tt.ops {
+				if got := forward(op); got != tt.want[i] {
+					t.Fatalf("expected event %d to be passed on %v, got %v", i, tt.want[i], got)
+				}
+			}
+		})
+	}
+	if r.forward("db.other") != nil {
+		t.Fatal("expected nothing to be skipped for a stream without a saved token")
+	}
+}
+
+func TestTakeToken(t *testing.T) {
+	token := testToken(primitive.Timestamp{T: 1, I: 1}, "")
+	op := tokenOp(primitive.Timestamp{T: 1, I: 1}, token)
+	op.Data["v"] = 1
+	if got := takeToken(op); !tokensEqual(got, token) {
+		t.Fatalf("expected the token to be taken, got %v", got)
+	}
+	if _, ok := op.Data[resumeTokenField]; ok || len(op.Data) != 1 {
+		t.Fatalf("expected the token to be removed from the document, got %v", op.Data)
+	}
+	if streamKey("") != deploymentStream || streamKey("db") != "db" {
+		t.Fatal("expected the deployment stream to be saved under its own key")
+	}
+}
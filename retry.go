@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// rejectedError is a write the destination refused, e.g. a partial write or
+// unparsable points. Retrying the same batch will not succeed
+type rejectedError struct {
+	err error
+}
+
+func (e *rejectedError) Error() string {
+	return e.err.Error()
+}
+
+func isRejected(err error) bool {
+	_, ok := err.(*rejectedError)
+	return ok
+}
+
+// rejectedStatus reports whether an HTTP status from a write means the batch itself is bad
+func rejectedStatus(status int) bool {
+	return status >= 400 && status < 500 && status != 429 && status != 408
+}
+
+// rejectedMessage reports whether an InfluxDB 1.X write error means the batch itself is bad.
+// The 1.X client does not expose the status code, only the error text of the response
+func rejectedMessage(err error) bool {
+	msg := err.Error()
+	for _, s := range []string{"partial write", "unable to parse", "field type conflict", "points beyond retention policy"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+type retrier struct {
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	jitter      float64
+}
+
+func RetryDefaultSettings() retrySettings {
+	return retrySettings{
+		MaxAttempts: 5,
+		Backoff:     "500ms",
+		MaxBackoff:  "30s",
+		Jitter:      0.2,
+	}
+}
+
+func (config *configOptions) NewRetrier() (*retrier, error) {
+	rs := config.RetrySettings
+	backoff, err := time.ParseDuration(rs.Backoff)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse retry backoff %s: %s", rs.Backoff, err)
+	}
+	maxBackoff, err := time.ParseDuration(rs.MaxBackoff)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse retry max backoff %s: %s", rs.MaxBackoff, err)
+	}
+	if rs.Jitter < 0 || rs.Jitter > 1 {
+		return nil, fmt.Errorf("Retry jitter must be between 0 and 1")
+	}
+	r := &retrier{
+		maxAttempts: rs.MaxAttempts,
+		backoff:     backoff,
+		maxBackoff:  maxBackoff,
+		jitter:      rs.Jitter,
+	}
+	if r.maxAttempts < 1 {
+		r.maxAttempts = 1
+	}
+	return r, nil
+}
+
+func (r *retrier) delay(attempt int) time.Duration {
+	d := r.backoff
+	for i := 1; i < attempt && d < r.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.maxBackoff {
+		d = r.maxBackoff
+	}
+	if r.jitter > 0 {
+		d += time.Duration(float64(d) * r.jitter * (rand.Float64()*2 - 1))
+	}
+	return d
+}
+
+// do calls f until it succeeds, returns a rejected error, or runs out of attempts
+func (r *retrier) do(f func() error) (err error) {
+	for attempt := 1; ; attempt++ {
+		if err = f(); err == nil || isRejected(err) || attempt >= r.maxAttempts {
+			return
+		}
+		d := r.delay(attempt)
+		errorLog.Printf("Write attempt %d failed, retrying in %s: %s", attempt, d, err)
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"github.com/influxdata/influxdb1-client/v2"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Sink is the destination that batches of points are written to.
+// The workers in main only talk to a Sink so that the backend can be swapped
+type Sink interface {
+	// Write sends every point in the batch to the destination
+	Write(bp client.BatchPoints) error
+	// CreateDatabase makes sure the database for db and retention rp exists at the destination
+	CreateDatabase(db, rp string) error
+	// Close releases any resources held by the sink
+	Close() error
+}
+
+// Deleter is implemented by sinks that can remove the series of a deleted document
+type Deleter interface {
+	// DeleteSeries drops the points of measurement in db and retention rp having every tag in tags.
+	// An empty measurement matches every measurement in the database
+	DeleteSeries(db, rp, measurement string, tags map[string]string) error
+}
+
+// deleterOf returns sink as a Deleter when its output can delete series. A spool
+// can only delete series when the output it writes to can
+func deleterOf(sink Sink) (Deleter, bool) {
+	if s, ok := sink.(*spoolSink); ok {
+		if _, ok := s.inner.(Deleter); !ok {
+			return nil, false
+		}
+	}
+	d, ok := sink.(Deleter)
+	return d, ok
+}
+
+// Pinger is implemented by sinks that can check that the destination is reachable
+type Pinger interface {
+	// Ping returns an error when the destination does not respond within timeout
+	Ping(timeout time.Duration) error
+}
+
+// influxHTTPSink writes batches to InfluxDB 1.X over HTTP
+type influxHTTPSink struct {
+	c client.Client
+}
+
+func (s *influxHTTPSink) Write(bp client.BatchPoints) error {
+	err := s.c.Write(bp)
+	if err != nil && rejectedMessage(err) {
+		return &rejectedError{err: err}
+	}
+	return err
+}
+
+func (s *influxHTTPSink) CreateDatabase(db, rp string) error {
+	q := client.NewQuery(fmt.Sprintf(`CREATE DATABASE "%s"`, db), "", "")
+	if response, err := s.c.Query(q); err != nil {
+		return err
+	} else {
+		return response.Error()
+	}
+}
+
+func (s *influxHTTPSink) DeleteSeries(db, rp, measurement string, tags map[string]string) error {
+	q := client.NewQuery(influxQLDelete(measurement, tags), db, "")
+	if response, err := s.c.Query(q); err != nil {
+		return err
+	} else {
+		return response.Error()
+	}
+}
+
+func (s *influxHTTPSink) Ping(timeout time.Duration) error {
+	_, _, err := s.c.Ping(timeout)
+	return err
+}
+
+func (s *influxHTTPSink) Close() error {
+	return s.c.Close()
+}
+
+func (config *configOptions) influxHTTPConfig() (client.HTTPConfig, error) {
+	httpConfig := client.HTTPConfig{
+		UserAgent:          fmt.Sprintf("%s v%s", Name, Version),
+		Addr:               config.InfluxURL,
+		Username:           config.InfluxUser,
+		Password:           config.InfluxPassword,
+		InsecureSkipVerify: config.InfluxSkipVerify,
+	}
+	if config.InfluxPemFile != "" {
+		tlsConfig, err := config.InfluxTLS()
+		if err != nil {
+			return httpConfig, fmt.Errorf("Unable to configure TLS for InfluxDB: %s", err)
+		}
+		httpConfig.TLSConfig = tlsConfig
+	}
+	return httpConfig, nil
+}
+
+func (config *configOptions) newInfluxHTTPSink() (Sink, error) {
+	httpConfig, err := config.influxHTTPConfig()
+	if err != nil {
+		return nil, err
+	}
+	c, err := client.NewHTTPClient(httpConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &influxHTTPSink{c: c}, nil
+}
+
+// NewSink creates the Sink that the workers write points to
+func (config *configOptions) NewSink() (Sink, error) {
+	output := config.Output
+	if config.DryRun {
+		return &dryRunSink{}, nil
+	} else if output == "stdout" {
+		return newLineProtocolSink("")
+	} else if strings.HasPrefix(output, "file:") {
+		return newLineProtocolSink(strings.TrimPrefix(output, "file:"))
+	} else if strings.HasPrefix(output, "remote-write:") {
+		return config.newRemoteWriteSink(strings.TrimPrefix(output, "remote-write:"))
+	} else if output != "" && output != "influx" {
+		return nil, fmt.Errorf("Unsupported output %s", output)
+	}
+	if config.InfluxUDPAddr != "" {
+		return config.newUDPSink(config.InfluxUDPAddr)
+	}
+	if config.InfluxToken != "" || config.InfluxOrg != "" {
+		return config.newInfluxV2Sink()
+	}
+	return config.newInfluxHTTPSink()
+}
+
+func quoteIdent(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func quoteString(s string) string {
+	return `'` + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + `'`
+}
+
+// influxQLDelete builds the DELETE statement for the series matching measurement and tags
+func influxQLDelete(measurement string, tags map[string]string) string {
+	var b strings.Builder
+	b.WriteString("DELETE")
+	if measurement != "" {
+		b.WriteString(" FROM ")
+		b.WriteString(quoteIdent(measurement))
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		if i == 0 {
+			b.WriteString(" WHERE ")
+		} else {
+			b.WriteString(" AND ")
+		}
+		b.WriteString(quoteIdent(k))
+		b.WriteString(" = ")
+		b.WriteString(quoteString(tags[k]))
+	}
+	return b.String()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"github.com/influxdata/influxdb1-client/v2"
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memorySink keeps the batches written to it. Writes fail with err while it is set
+type memorySink struct {
+	lock    sync.Mutex
+	batches []client.BatchPoints
+	dbs     []string
+	err     error
+}
+
+func (s *memorySink) Write(bp client.BatchPoints) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.batches = append(s.batches, bp)
+	return nil
+}
+
+func (s *memorySink) setErr(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.err = err
+}
+
+func (s *memorySink) CreateDatabase(db, rp string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.dbs = append(s.dbs, db)
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	return nil
+}
+
+// lines returns the points written in line protocol
+func (s *memorySink) lines() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var lines []string
+	for _, bp := range s.batches {
+		for _, p := range bp.Points() {
+			lines = append(lines, p.String())
+		}
+	}
+	return lines
+}
+
+func newTestCtx(t *testing.T, sink Sink, bufferSize int, mss ...*measureSettings) *InfluxCtx {
+	config := newConfig()
+	config.InfluxBufferSize = bufferSize
+	config.RetrySettings.MaxAttempts = 1
+	config.Measurement = mss
+	retry, err := config.NewRetrier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &InfluxCtx{
+		id:       1,
+		sink:     sink,
+		m:        make(map[*InfluxMeasure]client.BatchPoints),
+		dbs:      make(map[string]bool),
+		measures: make(map[string][]*InfluxMeasure),
+		resolved: make(map[string][]*InfluxMeasure),
+		config:   config,
+		retry:    retry,
+		tokens:   make(map[string]*resumeToken),
+		ckpt:     newCheckpoint(nil),
+	}
+	if err := ctx.setupMeasurements(); err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
+
+func testInsert(id string, v int, ts uint32) *gtm.Op {
+	return &gtm.Op{
+		Id:        id,
+		Namespace: "db.col",
+		Operation: "i",
+		Source:    gtm.OplogQuerySource,
+		Timestamp: primitive.Timestamp{T: ts, I: 1},
+		Data:      map[string]interface{}{"_id": id, "v": v},
+	}
+}
+
+func bufferedPoints(ctx *InfluxCtx) int {
+	n := 0
+	for _, bp := range ctx.m {
+		n += len(bp.Points())
+	}
+	return n
+}
+
+func testMeasurement() *measureSettings {
+	return &measureSettings{Namespace: "db.col", Tags: []string{"_id:id"}, Fields: []string{"v"}}
+}
+
+func TestAddPointBuffers(t *testing.T) {
+	sink := &memorySink{}
+	ctx := newTestCtx(t, sink, 3, testMeasurement())
+	for i, id := range []string{"a", "b"} {
+		if err := ctx.addPoint(testInsert(id, i, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sink.batches) != 0 {
+		t.Fatalf("expected no writes before the buffer is full, got %d", len(sink.batches))
+	}
+	if n := bufferedPoints(ctx); n != 2 {
+		t.Fatalf("expected 2 buffered points, got %d", n)
+	}
+	if len(sink.dbs) != 1 || sink.dbs[0] != "db" {
+		t.Fatalf("expected database db to be created once, got %v", sink.dbs)
+	}
+}
+
+func TestAddPointFlushesAtBufferSize(t *testing.T) {
+	sink := &memorySink{}
+	ctx := newTestCtx(t, sink, 3, testMeasurement())
+	for i, id := range []string{"a", "b", "c"} {
+		if err := ctx.addPoint(testInsert(id, i, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sink.batches) != 1 {
+		t.Fatalf("expected 1 batch written, got %d", len(sink.batches))
+	}
+	lines := sink.lines()
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 points written, got %v", lines)
+	}
+	if want := "col,id=a v=0i 100000000000"; lines[0] != want {
+		t.Fatalf("expected %q, got %q", want, lines[0])
+	}
+	if n := bufferedPoints(ctx); n != 0 {
+		t.Fatalf("expected the buffer to be empty after the flush, got %d points", n)
+	}
+}
+
+func TestWriteBatchKeepsBatchOnError(t *testing.T) {
+	sink := &memorySink{err: errors.New("connection refused")}
+	ctx := newTestCtx(t, sink, 10, testMeasurement())
+	if err := ctx.addPoint(testInsert("a", 1, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.writeBatch(); err == nil {
+		t.Fatal("expected the write error to be returned")
+	}
+	if n := bufferedPoints(ctx); n != 1 {
+		t.Fatalf("expected the failed batch to be kept, got %d points", n)
+	}
+	sink.err = nil
+	if err := ctx.writeBatch(); err != nil {
+		t.Fatal(err)
+	}
+	if lines := sink.lines(); len(lines) != 1 || !strings.HasPrefix(lines[0], "col,id=a v=1i") {
+		t.Fatalf("expected the kept point to be written on the next flush, got %v", lines)
+	}
+	if n := bufferedPoints(ctx); n != 0 {
+		t.Fatalf("expected the buffer to be empty, got %d points", n)
+	}
+}
+
+func TestWriteBatchDropsRejectedBatch(t *testing.T) {
+	sink := &memorySink{err: &rejectedError{err: errors.New("unable to parse")}}
+	ctx := newTestCtx(t, sink, 10, testMeasurement())
+	if err := ctx.addPoint(testInsert("a", 1, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.writeBatch(); err == nil {
+		t.Fatal("expected the rejection to be returned")
+	}
+	if n := bufferedPoints(ctx); n != 0 {
+		t.Fatalf("expected the rejected batch to be dropped, got %d points", n)
+	}
+}
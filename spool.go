@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/influxdata/influxdb1-client/models"
+	"github.com/influxdata/influxdb1-client/v2"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spoolBlock        = "block"
+	spoolDropOldest   = "drop-oldest"
+	spoolSegmentSize  = 16 * 1024 * 1024
+	spoolSegmentExt   = ".seg"
+	spoolSegmentDigit = 20
+)
+
+// spoolSink sits in front of the main sink. While the sink is unavailable batches
+// are appended to segment files under a directory and a background goroutine
+// drains the segments in order once writes succeed again.
+// Batches are written straight through whenever nothing is spooled
+type spoolSink struct {
+	inner       Sink
+	dir         string
+	maxBytes    int64
+	segmentSize int64
+	policy      string
+	retry       *retrier
+	lock        sync.Mutex
+	cond        *sync.Cond
+	segments    []*spoolSegment
+	active      *os.File
+	draining    *spoolSegment
+	size        int64
+	seq         int64
+	dbs         map[[2]string]bool
+	wakeC       chan bool
+	stopC       chan bool
+	doneC       chan bool
+	closed      bool
+	// order keeps direct writes from landing ahead of spooled batches. Direct
+	// writes hold it shared and batches are spooled holding it exclusively
+	order sync.RWMutex
+}
+
+type spoolSegment struct {
+	path string
+	size int64
+}
+
+type spoolRecord struct {
+	Database  string `json:"db"`
+	Retention string `json:"rp,omitempty"`
+	Precision string `json:"precision"`
+	Points    string `json:"points"`
+}
+
+func newSpoolSink(inner Sink, config *configOptions, retry *retrier) (*spoolSink, error) {
+	if err := config.checkSpoolFullPolicy(); err != nil {
+		return nil, err
+	}
+	policy := config.SpoolFullPolicy
+	if policy == "" {
+		policy = spoolBlock
+	}
+	if err := os.MkdirAll(config.SpoolDir, 0755); err != nil {
+		return nil, err
+	}
+	s := &spoolSink{
+		inner:       inner,
+		dir:         config.SpoolDir,
+		maxBytes:    config.SpoolMaxSize,
+		segmentSize: spoolSegmentSize,
+		policy:      policy,
+		retry:       retry,
+		dbs:         make(map[[2]string]bool),
+		wakeC:       make(chan bool, 1),
+		stopC:       make(chan bool),
+		doneC:       make(chan bool),
+	}
+	s.cond = sync.NewCond(&s.lock)
+	if s.maxBytes > 0 && s.maxBytes/4 < s.segmentSize {
+		s.segmentSize = s.maxBytes / 4
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if len(s.segments) > 0 {
+		infoLog.Printf("Draining %d bytes of spooled points from %s", s.size, s.dir)
+	}
+	go s.drain()
+	return s, nil
+}
+
+// load picks up segments left behind by a previous run
+func (s *spoolSink) load() error {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*"+spoolSegmentExt))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		seq, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(path), spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, &spoolSegment{path: path, size: info.Size()})
+		s.size += info.Size()
+		s.seq = seq
+	}
+	return nil
+}
+
+func (s *spoolSink) pending() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.segments) > 0 || len(s.dbs) > 0
+}
+
+func (s *spoolSink) wake() {
+	select {
+	case s.wakeC <- true:
+	default:
+	}
+}
+
+func (s *spoolSink) Write(bp client.BatchPoints) error {
+	s.order.RLock()
+	if !s.pending() {
+		err := s.inner.Write(bp)
+		if err == nil || isRejected(err) {
+			s.order.RUnlock()
+			return err
+		}
+		errorLog.Printf("Spooling %d points to %s: %s", len(bp.Points()), s.dir, err)
+	}
+	s.order.RUnlock()
+	s.order.Lock()
+	defer s.order.Unlock()
+	return s.spool(bp)
+}
+
+func (s *spoolSink) spool(bp client.BatchPoints) error {
+	var b strings.Builder
+	for _, p := range bp.Points() {
+		if p == nil {
+			continue
+		}
+		b.WriteString(p.PrecisionString(bp.Precision()))
+		b.WriteByte('\n')
+	}
+	data, err := json.Marshal(&spoolRecord{
+		Database:  bp.Database(),
+		Retention: bp.RetentionPolicy(),
+		Precision: bp.Precision(),
+		Points:    b.String(),
+	})
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.append(data)
+}
+
+// append writes a record to the active segment. Must be called with the lock held
+func (s *spoolSink) append(data []byte) error {
+	for s.maxBytes > 0 && s.size+int64(len(data)) > s.maxBytes && len(s.segments) > 0 {
+		if s.policy == spoolDropOldest && s.dropOldest() {
+			continue
+		}
+		if s.closed {
+			return fmt.Errorf("Unable to spool points, %s is closed", s.dir)
+		}
+		s.wake()
+		s.cond.Wait()
+	}
+	if s.active == nil || s.segments[len(s.segments)-1].size >= s.segmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.active.Write(data); err != nil {
+		return err
+	}
+	if err := s.active.Sync(); err != nil {
+		return err
+	}
+	s.segments[len(s.segments)-1].size += int64(len(data))
+	s.size += int64(len(data))
+	s.wake()
+	return nil
+}
+
+// rotate closes the active segment and starts a new one. Must be called with the lock held
+func (s *spoolSink) rotate() error {
+	if s.active != nil {
+		s.active.Close()
+		s.active = nil
+	}
+	s.seq++
+	path := filepath.Join(s.dir, fmt.Sprintf("%0*d%s", spoolSegmentDigit, s.seq, spoolSegmentExt))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.active = f
+	s.segments = append(s.segments, &spoolSegment{path: path})
+	return nil
+}
+
+// dropOldest removes the oldest segment that is not being drained or written.
+// Must be called with the lock held
+func (s *spoolSink) dropOldest() bool {
+	for i, seg := range s.segments {
+		if seg == s.draining || (s.active != nil && i == len(s.segments)-1) {
+			continue
+		}
+		if err := os.Remove(seg.path); err != nil {
+			errorLog.Printf("Unable to remove spool segment %s: %s", seg.path, err)
+			return false
+		}
+		errorLog.Printf("Spool is full, dropped %d bytes of points from %s", seg.size, seg.path)
+		s.size -= seg.size
+		s.segments = append(s.segments[:i], s.segments[i+1:]...)
+		return true
+	}
+	return false
+}
+
+// next returns the oldest segment to drain, closing it first if it is the active one
+func (s *spoolSink) next() *spoolSegment {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.segments) == 0 {
+		return nil
+	}
+	if s.active != nil && len(s.segments) == 1 {
+		s.active.Close()
+		s.active = nil
+	}
+	s.draining = s.segments[0]
+	return s.draining
+}
+
+func (s *spoolSink) done(seg *spoolSegment) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := os.Remove(seg.path); err != nil {
+		errorLog.Printf("Unable to remove spool segment %s: %s", seg.path, err)
+	}
+	s.draining = nil
+	for i, other := range s.segments {
+		if other == seg {
+			s.size -= seg.size
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			break
+		}
+	}
+	s.cond.Broadcast()
+}
+
+func (s *spoolSink) sleep(attempt int) bool {
+	select {
+	case <-s.stopC:
+		return false
+	case <-time.After(s.retry.delay(attempt)):
+		return true
+	}
+}
+
+// until calls f until it succeeds or the spool is closed
+func (s *spoolSink) until(f func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || isRejected(err) {
+			return err
+		}
+		if attempt == 1 {
+			errorLog.Printf("Unable to drain spool, will retry: %s", err)
+		}
+		if !s.sleep(attempt) {
+			return err
+		}
+	}
+}
+
+func (s *spoolSink) createDatabases() bool {
+	s.lock.Lock()
+	var dbs [][2]string
+	for db := range s.dbs {
+		dbs = append(dbs, db)
+	}
+	s.lock.Unlock()
+	for _, db := range dbs {
+		if err := s.until(func() error { return s.inner.CreateDatabase(db[0], db[1]) }); err != nil {
+			select {
+			case <-s.stopC:
+				return false
+			default:
+				errorLog.Printf("Unable to create database %s: %s", db[0], err)
+			}
+		}
+		s.lock.Lock()
+		delete(s.dbs, db)
+		s.lock.Unlock()
+	}
+	return true
+}
+
+func (s *spoolSink) drainSegment(seg *spoolSegment) bool {
+	f, err := os.Open(seg.path)
+	if err != nil {
+		errorLog.Printf("Unable to open spool segment %s: %s", seg.path, err)
+		return true
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// a partial record is left when the process died mid write
+			return true
+		} else if err != nil {
+			errorLog.Printf("Unable to read spool segment %s: %s", seg.path, err)
+			return true
+		}
+		var rec spoolRecord
+		if err = json.Unmarshal(line, &rec); err != nil {
+			errorLog.Printf("Skipping corrupt record in spool segment %s: %s", seg.path, err)
+			continue
+		}
+		bp, err := rec.batch()
+		if err != nil {
+			errorLog.Printf("Skipping corrupt record in spool segment %s: %s", seg.path, err)
+			continue
+		}
+		if err = s.until(func() error { return s.inner.Write(bp) }); err != nil {
+			select {
+			case <-s.stopC:
+				return false
+			default:
+				errorLog.Printf("Dropped %d spooled points: %s", len(bp.Points()), err)
+			}
+		}
+	}
+}
+
+func (rec *spoolRecord) batch() (client.BatchPoints, error) {
+	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
+		Database:        rec.Database,
+		RetentionPolicy: rec.Retention,
+		Precision:       rec.Precision,
+	})
+	if err != nil {
+		return nil, err
+	}
+	pts, err := models.ParsePointsWithPrecision([]byte(rec.Points), time.Now().UTC(), rec.Precision)
+	if err != nil {
+		return nil, err
+	}
+	for _, pt := range pts {
+		bp.AddPoint(client.NewPointFrom(pt))
+	}
+	return bp, nil
+}
+
+func (s *spoolSink) drain() {
+	defer close(s.doneC)
+	for {
+		select {
+		case <-s.stopC:
+			return
+		case <-s.wakeC:
+		case <-time.After(time.Second):
+		}
+		if !s.createDatabases() {
+			return
+		}
+		for seg := s.next(); seg != nil; seg = s.next() {
+			if !s.drainSegment(seg) {
+				return
+			}
+			s.done(seg)
+		}
+	}
+}
+
+// CreateDatabase remembers databases that could not be created so that they
+// are created before the spool is drained
+func (s *spoolSink) CreateDatabase(db, rp string) error {
+	if err := s.inner.CreateDatabase(db, rp); err != nil {
+		if isRejected(err) {
+			return err
+		}
+		errorLog.Printf("Unable to create database %s, will retry: %s", db, err)
+		s.lock.Lock()
+		s.dbs[[2]string{db, rp}] = true
+		s.lock.Unlock()
+		s.wake()
+	}
+	return nil
+}
+
+// DeleteSeries is passed on to the inner sink once the spool has drained so that
+// the delete cannot be overtaken by spooled points of the same series
+func (s *spoolSink) DeleteSeries(db, rp, measurement string, tags map[string]string) error {
+	d, ok := s.inner.(Deleter)
+	if !ok {
+		return &rejectedError{err: fmt.Errorf("Output does not support deleting series")}
+	}
+	s.order.RLock()
+	defer s.order.RUnlock()
+	if s.pending() {
+		return fmt.Errorf("Unable to delete series while points are spooled in %s", s.dir)
+	}
+	return d.DeleteSeries(db, rp, measurement, tags)
+}
+
+func (s *spoolSink) Ping(timeout time.Duration) error {
+	if p, ok := s.inner.(Pinger); ok {
+		return p.Ping(timeout)
+	}
+	return nil
+}
+
+func (s *spoolSink) Close() error {
+	s.lock.Lock()
+	// writers waiting for space give up since the spool will not drain
+	s.closed = true
+	s.cond.Broadcast()
+	s.lock.Unlock()
+	close(s.stopC)
+	<-s.doneC
+	s.lock.Lock()
+	if s.active != nil {
+		s.active.Close()
+		s.active = nil
+	}
+	if len(s.segments) > 0 {
+		infoLog.Printf("%d bytes of points remain spooled in %s", s.size, s.dir)
+	}
+	s.lock.Unlock()
+	return s.inner.Close()
+}
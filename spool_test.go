@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/influxdata/influxdb1-client/v2"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestSpool(t *testing.T, inner Sink, dir string, maxBytes int64, policy string) *spoolSink {
+	config := newConfig()
+	config.SpoolDir = dir
+	config.SpoolMaxSize = maxBytes
+	config.SpoolFullPolicy = policy
+	config.RetrySettings.Backoff = "1ms"
+	config.RetrySettings.MaxBackoff = "5ms"
+	retry, err := config.NewRetrier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSpoolSink(inner, config, retry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func spoolBatch(t *testing.T, v int) client.BatchPoints {
+	bp, _ := client.NewBatchPoints(client.BatchPointsConfig{Database: "db"})
+	pt, err := client.NewPoint("col", map[string]string{"id": "a"}, map[string]interface{}{"v": v}, time.Unix(int64(100+v), 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp.AddPoint(pt)
+	return bp
+}
+
+func spoolLines(from, to int) []string {
+	var lines []string
+	for v := from; v < to; v++ {
+		lines = append(lines, fmt.Sprintf("col,id=a v=%di %d000000000", v, 100+v))
+	}
+	return lines
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+spoolSegmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// writeAll writes batches 0 to n-1 in the background and closes the returned
+// channel with the first error once done
+func writeAll(t *testing.T, s *spoolSink, n int) chan error {
+	done := make(chan error, 1)
+	go func() {
+		defer close(done)
+		for v := 0; v < n; v++ {
+			if err := s.Write(spoolBatch(t, v)); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	return done
+}
+
+func TestSpoolOnFailure(t *testing.T) {
+	inner := &memorySink{err: errors.New("connection refused")}
+	s := newTestSpool(t, inner, t.TempDir(), 0, "")
+	defer s.Close()
+	for v := 0; v < 2; v++ {
+		if err := s.Write(spoolBatch(t, v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lines := inner.lines(); len(lines) != 0 {
+		t.Fatalf("expected nothing written while the output fails, got %v", lines)
+	}
+	if !s.pending() {
+		t.Fatal("expected the batches to be spooled")
+	}
+	inner.setErr(nil)
+	// spooled points are still pending so this batch is spooled behind them
+	if err := s.Write(spoolBatch(t, 2)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the spool to drain", func() bool { return !s.pending() })
+	if err := s.Write(spoolBatch(t, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := inner.lines(), spoolLines(0, 4); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestSpoolReplayAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	failing := &memorySink{err: errors.New("connection refused")}
+	s := newTestSpool(t, failing, dir, 0, "")
+	for v := 0; v < 3; v++ {
+		if err := s.Write(spoolBatch(t, v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+	if len(segmentFiles(t, dir)) == 0 {
+		t.Fatal("expected the spooled points to be kept on close")
+	}
+	inner := &memorySink{}
+	s = newTestSpool(t, inner, dir, 0, "")
+	defer s.Close()
+	waitFor(t, "the spool to drain", func() bool { return !s.pending() })
+	if got, want := inner.lines(), spoolLines(0, 3); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	if files := segmentFiles(t, dir); len(files) != 0 {
+		t.Fatalf("expected drained segments to be removed, got %v", files)
+	}
+}
+
+func TestSpoolSegmentRotation(t *testing.T) {
+	dir := t.TempDir()
+	inner := &memorySink{err: errors.New("connection refused")}
+	s := newTestSpool(t, inner, dir, 0, "")
+	defer s.Close()
+	s.lock.Lock()
+	s.segmentSize = 1
+	s.lock.Unlock()
+	for v := 0; v < 3; v++ {
+		if err := s.Write(spoolBatch(t, v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if files := segmentFiles(t, dir); len(files) != 3 {
+		t.Fatalf("expected a segment per batch, got %v", files)
+	}
+	inner.setErr(nil)
+	s.wake()
+	waitFor(t, "the spool to drain", func() bool { return !s.pending() })
+	if got, want := inner.lines(), spoolLines(0, 3); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	if files := segmentFiles(t, dir); len(files) != 0 {
+		t.Fatalf("expected drained segments to be removed, got %v", files)
+	}
+}
+
+func TestSpoolDropOldest(t *testing.T) {
+	const maxBytes = 400
+	inner := &memorySink{err: errors.New("connection refused")}
+	s := newTestSpool(t, inner, t.TempDir(), maxBytes, spoolDropOldest)
+	defer s.Close()
+	select {
+	case err := <-writeAll(t, s, 20):
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected writes not to block when dropping the oldest points")
+	}
+	s.lock.Lock()
+	size := s.size
+	s.lock.Unlock()
+	if size > maxBytes {
+		t.Fatalf("expected the spool to stay within %d bytes, got %d", maxBytes, size)
+	}
+	inner.setErr(nil)
+	s.wake()
+	waitFor(t, "the spool to drain", func() bool { return !s.pending() })
+	lines := inner.lines()
+	if len(lines) == 0 || len(lines) >= 20 {
+		t.Fatalf("expected some of the oldest points to be dropped, got %q", lines)
+	}
+	if last := spoolLines(19, 20)[0]; lines[len(lines)-1] != last {
+		t.Fatalf("expected the newest point %q to be kept, got %q", last, lines)
+	}
+}
+
+func TestSpoolBlockWhenFull(t *testing.T) {
+	inner := &memorySink{err: errors.New("connection refused")}
+	s := newTestSpool(t, inner, t.TempDir(), 400, spoolBlock)
+	defer s.Close()
+	done := writeAll(t, s, 20)
+	select {
+	case <-done:
+		t.Fatal("expected writes to block while the spool is full")
+	case <-time.After(200 * time.Millisecond):
+	}
+	inner.setErr(nil)
+	s.wake()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected blocked writes to continue once the spool drains")
+	}
+	waitFor(t, "the spool to drain", func() bool { return !s.pending() })
+	if got, want := inner.lines(), spoolLines(0, 20); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected every point in order %q, got %q", want, got)
+	}
+}
+
+func TestSpoolCloseReleasesBlockedWriter(t *testing.T) {
+	inner := &memorySink{err: errors.New("connection refused")}
+	s := newTestSpool(t, inner, t.TempDir(), 400, spoolBlock)
+	done := writeAll(t, s, 20)
+	select {
+	case <-done:
+		t.Fatal("expected writes to block while the spool is full")
+	case <-time.After(200 * time.Millisecond):
+	}
+	closed := make(chan error)
+	go func() { closed <- s.Close() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected the blocked write to fail once the spool is closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the blocked write to return on close")
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected close to return")
+	}
+}
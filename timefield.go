@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	timeEpochS    = "epoch_s"
+	timeEpochMs   = "epoch_ms"
+	timeEpochUs   = "epoch_us"
+	timeEpochNs   = "epoch_ns"
+	timeObjectID  = "objectid"
+	timeLayoutISO = time.RFC3339Nano
+)
+
+// lookupPath returns the value at the dotted path k of doc
+func lookupPath(doc map[string]interface{}, k string) (interface{}, bool) {
+	if v, ok := doc[k]; ok {
+		return v, true
+	}
+	parts := strings.SplitN(k, ".", 2)
+	if len(parts) < 2 {
+		return nil, false
+	}
+	switch child := doc[parts[0]].(type) {
+	case map[string]interface{}:
+		return lookupPath(child, parts[1])
+	case primitive.D:
+		return lookupPath(child.Map(), parts[1])
+	default:
+		return nil, false
+	}
+}
+
+func epochUnit(format string) (time.Duration, bool) {
+	switch format {
+	case timeEpochS:
+		return time.Second, true
+	case timeEpochMs:
+		return time.Millisecond, true
+	case timeEpochUs:
+		return time.Microsecond, true
+	case timeEpochNs:
+		return time.Nanosecond, true
+	default:
+		return 0, false
+	}
+}
+
+// parseTime converts the value of a time field to a time. Dates and timestamps
+// are always accepted. Otherwise format is an epoch unit, objectid to take the
+// time from an ObjectId, or a golang time layout for strings defaulting to RFC3339
+func parseTime(v interface{}, format string) (time.Time, error) {
+	switch vt := v.(type) {
+	case time.Time:
+		return vt.UTC(), nil
+	case primitive.DateTime:
+		return time.Unix(0, int64(vt)*int64(time.Millisecond)).UTC(), nil
+	case primitive.Timestamp:
+		return TimestampTime(vt), nil
+	case primitive.ObjectID:
+		if format == timeObjectID {
+			return vt.Timestamp().UTC(), nil
+		}
+	}
+	if unit, ok := epochUnit(format); ok {
+		switch v.(type) {
+		case bool, time.Time, primitive.DateTime:
+		default:
+			if i, err := toInt(v); err == nil {
+				if i > math.MaxInt64/int64(unit) || i < math.MinInt64/int64(unit) {
+					return time.Time{}, fmt.Errorf("%v is out of range for %s", v, format)
+				}
+				return time.Unix(0, i*int64(unit)).UTC(), nil
+			}
+			if f, err := toFloat(v); err == nil {
+				return epochTime(f, unit)
+			}
+		}
+		return time.Time{}, fmt.Errorf("%s expects a number but had %T %v", format, v, v)
+	}
+	if format == timeObjectID {
+		return time.Time{}, fmt.Errorf("%s expects an ObjectId but had type %T", format, v)
+	}
+	if s, ok := v.(string); ok {
+		layout := format
+		if layout == "" {
+			layout = timeLayoutISO
+		}
+		t, err := time.Parse(layout, s)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return t.UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("had type %T, but expected %T", v, time.Time{})
+}
+
+func epochTime(f float64, unit time.Duration) (time.Time, error) {
+	ns := f * float64(unit)
+	if ns >= math.MaxInt64 || ns <= math.MinInt64 {
+		return time.Time{}, fmt.Errorf("%v is out of range", f)
+	}
+	return time.Unix(0, int64(ns)).UTC(), nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	want := time.Date(2019, 5, 10, 14, 30, 0, 0, time.UTC)
+	oid, _ := primitive.ObjectIDFromHex("5cd58b2d0000000000000000")
+	tests := []struct {
+		name   string
+		v      interface{}
+		format string
+		want   time.Time
+		valid  bool
+	}{
+		{"date", want.In(time.FixedZone("CET", 3600)), "", want, true},
+		{"bson date", primitive.DateTime(want.UnixNano() / int64(time.Millisecond)), "epoch_s", want, true},
+		{"timestamp", primitive.Timestamp{T: uint32(want.Unix()), I: 3}, "", want, true},
+		{"objectid", oid, "objectid", time.Unix(0x5cd58b2d, 0).UTC(), true},
+		{"objectid without format", oid, "", time.Time{}, false},
+		{"objectid format on string", "5cd58b2d0000000000000000", "objectid", time.Time{}, false},
+		{"epoch_s", int64(want.Unix()), "epoch_s", want, true},
+		{"epoch_s int32", int32(want.Unix()), "epoch_s", want, true},
+		{"epoch_s fraction", float64(want.Unix()) + 0.5, "epoch_s", want.Add(500 * time.Millisecond), true},
+		{"epoch_s string", "1557498600", "epoch_s", want, true},
+		{"epoch_ms", want.UnixNano() / int64(time.Millisecond), "epoch_ms", want, true},
+		{"epoch_us", want.UnixNano() / int64(time.Microsecond), "epoch_us", want, true},
+		{"epoch_ns", want.UnixNano(), "epoch_ns", want, true},
+		{"epoch overflow", int64(1) << 62, "epoch_s", time.Time{}, false},
+		{"epoch float overflow", 1e300, "epoch_ms", time.Time{}, false},
+		{"epoch bool", true, "epoch_s", time.Time{}, false},
+		{"epoch text", "soon", "epoch_s", time.Time{}, false},
+		{"iso default", "2019-05-10T16:30:00+02:00", "", want, true},
+		{"iso nanoseconds", "2019-05-10T14:30:00.000000001Z", "", want.Add(time.Nanosecond), true},
+		{"layout", "10/05/2019 14:30", "02/01/2006 15:04", want, true},
+		{"layout mismatch", "2019-05-10", "02/01/2006", time.Time{}, false},
+		{"iso garbage", "yesterday", "", time.Time{}, false},
+		{"number without format", 1557498600, "", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTime(tt.v, tt.format)
+			if (err == nil) != tt.valid {
+				t.Fatalf("expected valid %v, got %v, %v", tt.valid, got, err)
+			}
+			if !got.Equal(tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLookupPath(t *testing.T) {
+	doc := map[string]interface{}{
+		"a.b": 1,
+		"c":   map[string]interface{}{"d": 2},
+		"e":   primitive.D{{Key: "f", Value: 3}},
+	}
+	for path, want := range map[string]interface{}{"a.b": 1, "c.d": 2, "e.f": 3} {
+		if got, ok := lookupPath(doc, path); !ok || got != want {
+			t.Fatalf("expected %v at %s, got %v", want, path, got)
+		}
+	}
+	if _, ok := lookupPath(doc, "c.x"); ok {
+		t.Fatal("expected no value at c.x")
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/influxdata/influxdb1-client/v2"
+)
+
+// udpSink writes batches to an InfluxDB UDP listener. Delivery is not
+// acknowledged so it suits high volume measurements that can tolerate loss.
+// Batches are split into packets no larger than the configured payload size
+type udpSink struct {
+	c client.Client
+}
+
+func (s *udpSink) Write(bp client.BatchPoints) error {
+	return s.c.Write(bp)
+}
+
+// CreateDatabase is a no-op since the database is fixed by the UDP listener config
+func (s *udpSink) CreateDatabase(db, rp string) error {
+	return nil
+}
+
+func (s *udpSink) Close() error {
+	return s.c.Close()
+}
+
+func (config *configOptions) newUDPSink(addr string) (Sink, error) {
+	c, err := client.NewUDPClient(client.UDPConfig{
+		Addr:        addr,
+		PayloadSize: config.InfluxUDPPayloadSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &udpSink{c: c}, nil
+}
+
+// LoadMeasureSinks creates the UDP sinks for measurements with their own udp-addr.
+// Measurements sharing an address share a sink
+func (config *configOptions) LoadMeasureSinks() (sinks []Sink, err error) {
+	byAddr := make(map[string]Sink)
+	for _, m := range config.Measurement {
+		if m.UDPAddr == "" || config.DryRun {
+			continue
+		}
+		sink := byAddr[m.UDPAddr]
+		if sink == nil {
+			if sink, err = config.newUDPSink(m.UDPAddr); err != nil {
+				return
+			}
+			byAddr[m.UDPAddr] = sink
+			sinks = append(sinks, sink)
+		}
+		m.sink = sink
+	}
+	return
+}
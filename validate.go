@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// checkMeasurements builds every measurement as a worker would and returns
+// the errors of each one
+func (config *configOptions) checkMeasurements(sink Sink) []error {
+	if len(config.Measurement) == 0 {
+		return []error{fmt.Errorf("at least one measurement is required")}
+	}
+	var errs []error
+	for _, m := range config.Measurement {
+		c := *config
+		c.Measurement = []*measureSettings{m}
+		check := &InfluxCtx{
+			sink:     sink,
+			config:   &c,
+			measures: make(map[string][]*InfluxMeasure),
+			resolved: make(map[string][]*InfluxMeasure),
+		}
+		if m.Symbol != "" && config.PluginPath == "" {
+			errs = append(errs, fmt.Errorf("measurement %s: symbol %s requires a plugin-path", m.pattern(), m.Symbol))
+		} else if err := check.setupMeasurements(); err != nil {
+			errs = append(errs, fmt.Errorf("measurement %s: %s", m.pattern(), err))
+		}
+	}
+	return errs
+}
+
+// checkResumeStore checks the resume-store option: mongo (default), file:/path or influx
+func (config *configOptions) checkResumeStore() error {
+	store := config.ResumeStore
+	if store == "" || store == "mongo" || store == "influx" {
+		return nil
+	} else if strings.HasPrefix(store, "file:") {
+		if strings.TrimPrefix(store, "file:") == "" {
+			return fmt.Errorf("The resume store %s requires a path", store)
+		}
+		return nil
+	}
+	return fmt.Errorf("Unsupported resume store %s", store)
+}
+
+// checkSpoolFullPolicy checks the spool-full-policy option: block (default) or drop-oldest
+func (config *configOptions) checkSpoolFullPolicy() error {
+	policy := config.SpoolFullPolicy
+	if policy == "" || policy == spoolBlock || policy == spoolDropOldest {
+		return nil
+	}
+	return fmt.Errorf("Unsupported spool full policy %s", policy)
+}
+
+// checkDeadLetter checks the dead-letter option: empty, mongo or file:/path
+func (config *configOptions) checkDeadLetter() error {
+	dl := config.DeadLetter
+	if dl == "" || dl == "mongo" {
+		return nil
+	} else if strings.HasPrefix(dl, "file:") {
+		if strings.TrimPrefix(dl, "file:") == "" {
+			return fmt.Errorf("The dead letter destination %s requires a path", dl)
+		}
+		return nil
+	}
+	return fmt.Errorf("Unsupported dead letter destination %s", dl)
+}
+
+func joinErrors(errs []error) string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// validationSink creates the output without opening files, which would truncate them
+func (config *configOptions) validationSink() (Sink, error) {
+	if !config.DryRun && (config.Output == "stdout" || strings.HasPrefix(config.Output, "file:")) {
+		return &lineProtocolSink{w: bufio.NewWriter(ioutil.Discard)}, nil
+	}
+	return config.NewSink()
+}
+
+// Validate checks the configuration file, environment and flags without connecting
+// to MongoDB or writing points and returns every problem found
+func (config *configOptions) Validate(flags *configOptions) (errs []error) {
+	unknown, err := config.load(flags)
+	for _, key := range unknown {
+		errs = append(errs, fmt.Errorf("Unknown option %s in %s", key, config.ConfigFile))
+	}
+	if err != nil {
+		return append(errs, err)
+	}
+	config.SetDefaults()
+	if _, err := config.NewRetrier(); err != nil {
+		errs = append(errs, err)
+	}
+	if config.Resume {
+		if err := config.checkResumeStore(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if config.SpoolDir != "" {
+		if err := config.checkSpoolFullPolicy(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := config.checkDeadLetter(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := time.ParseDuration(config.GtmSettings.BufferDuration); err != nil {
+		errs = append(errs, fmt.Errorf("Unable to parse gtm buffer duration %s: %s", config.GtmSettings.BufferDuration, err))
+	}
+	if err := config.loadPluginSymbols(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := config.compileNamespaces(); err != nil {
+		return append(errs, err)
+	}
+	if err := config.compileFilters(); err != nil {
+		errs = append(errs, err)
+	}
+	sink, err := config.validationSink()
+	if err != nil {
+		return append(errs, fmt.Errorf("Unable to create output: %s", err))
+	}
+	defer sink.Close()
+	measureSinks, err := config.LoadMeasureSinks()
+	defer closeSinks(measureSinks)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Unable to create InfluxDB UDP client: %s", err))
+	}
+	return append(errs, config.checkMeasurements(sink)...)
+}
+
+// runValidate implements the validate subcommand
+func (config *configOptions) runValidate(flags *configOptions) {
+	errs := config.Validate(flags)
+	for _, err := range errs {
+		errorLog.Println(err)
+	}
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+	infoLog.Printf("Configuration is valid with %d measurements", len(config.Measurement))
+	os.Exit(0)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestCheckOptionValues(t *testing.T) {
+	tests := []struct {
+		name  string
+		set   func(*configOptions)
+		check func(*configOptions) error
+		valid bool
+	}{
+		{"default resume store", func(c *configOptions) {}, (*configOptions).checkResumeStore, true},
+		{"file resume store", func(c *configOptions) { c.ResumeStore = "file:/tmp/resume.json" }, (*configOptions).checkResumeStore, true},
+		{"file resume store without path", func(c *configOptions) { c.ResumeStore = "file:" }, (*configOptions).checkResumeStore, false},
+		{"influx resume store", func(c *configOptions) { c.ResumeStore = "influx" }, (*configOptions).checkResumeStore, true},
+		{"unknown resume store", func(c *configOptions) { c.ResumeStore = "redis" }, (*configOptions).checkResumeStore, false},
+		{"block", func(c *configOptions) { c.SpoolFullPolicy = "block" }, (*configOptions).checkSpoolFullPolicy, true},
+		{"drop-oldest", func(c *configOptions) { c.SpoolFullPolicy = "drop-oldest" }, (*configOptions).checkSpoolFullPolicy, true},
+		{"drop-newest", func(c *configOptions) { c.SpoolFullPolicy = "drop-newest" }, (*configOptions).checkSpoolFullPolicy, false},
+		{"no dead letters", func(c *configOptions) {}, (*configOptions).checkDeadLetter, true},
+		{"mongo dead letters", func(c *configOptions) { c.DeadLetter = "mongo" }, (*configOptions).checkDeadLetter, true},
+		{"file dead letters", func(c *configOptions) { c.DeadLetter = "file:/tmp/dead.jsonl" }, (*configOptions).checkDeadLetter, true},
+		{"unknown dead letters", func(c *configOptions) { c.DeadLetter = "kafka" }, (*configOptions).checkDeadLetter, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := newConfig()
+			tt.set(config)
+			if err := tt.check(config); (err == nil) != tt.valid {
+				t.Fatalf("expected valid %v, got %v", tt.valid, err)
+			}
+		})
+	}
+}
+
+func TestNewSpoolSinkRejectsPolicy(t *testing.T) {
+	config := newConfig()
+	config.SpoolDir = t.TempDir()
+	config.SpoolFullPolicy = "drop-newest"
+	if _, err := newSpoolSink(&memorySink{}, config, nil); err == nil {
+		t.Fatal("expected the unsupported policy to be rejected")
+	}
+}
+
+const validMeasurement = `
+output = "stdout"
+
+[[measurement]]
+namespace = "db.col"
+tags = ["region"]
+fields = ["v"]
+`
+
+func TestValidateReportsErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{"valid", validMeasurement, ""},
+		{"unknown key", "influx-urll = \"http://localhost:8086\"\n" + validMeasurement, "Unknown option influx-urll"},
+		{"unknown measurement key", validMeasurement + "tag = [\"x\"]\n", "Unknown option measurement.tag"},
+		{"measure template", validMeasurement + "measure = \"{{.Collection\"\n", "measurement db.col: template"},
+		{"view", validMeasurement + "view = \"noview\"\n", "View namespace is invalid"},
+		{"namespace regex", strings.Replace(validMeasurement, `namespace = "db.col"`, `namespace-regex = "db.("`, 1), "Invalid namespace pattern"},
+		{"filter", validMeasurement + "filter = '{\"v\": {\"$near\": 1}}'\n", "Invalid filter for db.col"},
+		{"filter json", validMeasurement + "filter = '{\"v\": '\n", "Invalid filter for db.col"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := givenFlags(&configOptions{ConfigFile: writeConfigFile(t, tt.config)})
+			errs := newConfig().Validate(flags)
+			if tt.want == "" {
+				if len(errs) != 0 {
+					t.Fatalf("expected no errors, got %v", errs)
+				}
+				return
+			}
+			if !strings.Contains(joinErrors(errs), tt.want) {
+				t.Fatalf("expected an error containing %q, got %v", tt.want, errs)
+			}
+		})
+	}
+}
+
+func TestValidateExitStatus(t *testing.T) {
+	if path := os.Getenv("VALIDATE_TEST_CONFIG"); path != "" {
+		newConfig().runValidate(givenFlags(&configOptions{ConfigFile: path}))
+		return
+	}
+	tests := []struct {
+		name   string
+		config string
+		status int
+	}{
+		{"valid", validMeasurement, 0},
+		{"invalid", validMeasurement + "view = \"noview\"\n", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestValidateExitStatus$")
+			cmd.Env = append(os.Environ(), "VALIDATE_TEST_CONFIG="+writeConfigFile(t, tt.config))
+			status := 0
+			if err := cmd.Run(); err != nil {
+				exit, ok := err.(*exec.ExitError)
+				if !ok {
+					t.Fatal(err)
+				}
+				status = exit.ExitCode()
+			}
+			if status != tt.status {
+				t.Fatalf("expected exit status %d, got %d", tt.status, status)
+			}
+		})
+	}
+}